@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+var now = time.Now
+
+// canonicalJSON serializes a value with its object keys sorted at every
+// level, so logically equal values always produce the same bytes
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(generic)
+}
+
+// auditRecord builds the audit record of an event's outcome
+func auditRecord(ev *Event, outcome string) map[string]interface{} {
+	record := make(map[string]interface{})
+
+	data, err := json.Marshal(ev)
+	if err == nil {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err = d.Decode(&record)
+	}
+	if err != nil {
+		log.Printf("Warning: could not build audit record: %s", err.Error())
+	}
+
+	for _, key := range secretFields {
+		delete(record, key)
+	}
+
+	if ev.cfg.AuditOmitRules {
+		delete(record, "security_group_rules")
+		record["rule_counts"] = map[string]int{
+			"ingress": len(ev.SecurityGroupRules.Ingress),
+			"egress":  len(ev.SecurityGroupRules.Egress),
+		}
+	}
+
+	record["action"] = "delete"
+	record["outcome"] = outcome
+	record["timestamp"] = now().UTC().Format(time.RFC3339)
+
+	return record
+}
+
+// audit publishes a canonical audit record for the event
+func audit(ev *Event, outcome string) {
+	if ev.cfg.AuditSubject == "" {
+		return
+	}
+
+	data, err := canonicalJSON(auditRecord(ev, outcome))
+	if err != nil {
+		log.Printf("Warning: could not serialize audit record: %s", err.Error())
+		return
+	}
+
+	publish(ev.cfg, ev.cfg.AuditSubject, data)
+}
@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	Convey("Given logically equal values built in a different order", t, func() {
+		a := map[string]interface{}{}
+		a["zone"] = "eu-west-1"
+		a["id"] = "sg-0000000"
+		a["nested"] = map[string]interface{}{"b": 2, "a": 1}
+
+		b := map[string]interface{}{}
+		b["nested"] = map[string]interface{}{"a": 1, "b": 2}
+		b["id"] = "sg-0000000"
+		b["zone"] = "eu-west-1"
+
+		s := struct {
+			Zone   string         `json:"zone"`
+			Nested map[string]int `json:"nested"`
+			ID     string         `json:"id"`
+		}{"eu-west-1", map[string]int{"b": 2, "a": 1}, "sg-0000000"}
+
+		Convey("When serializing them canonically", func() {
+			ca, _ := canonicalJSON(a)
+			cb, _ := canonicalJSON(b)
+			cs, _ := canonicalJSON(s)
+
+			Convey("It should produce identical sorted bytes", func() {
+				So(string(ca), ShouldEqual, `{"id":"sg-0000000","nested":{"a":1,"b":2},"zone":"eu-west-1"}`)
+				So(string(cb), ShouldEqual, string(ca))
+				So(string(cs), ShouldEqual, string(ca))
+			})
+		})
+	})
+}
+
+func TestAudit(t *testing.T) {
+	testSetup()
+
+	Convey("Given an audit subject", t, func() {
+		cfg := defaultConfig()
+		cfg.AuditSubject = "test.audit"
+		now = func() time.Time { return time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC) }
+		audited := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("test.audit", audited)
+
+		Convey("When completing an event", func() {
+			e := testEvent
+			e.cfg = cfg
+			e.Complete()
+
+			Convey("It should publish a canonical audit record", func() {
+				msg, timeout := waitMsg(audited)
+				So(timeout, ShouldBeNil)
+				expected, _ := canonicalJSON(auditRecord(&e, "completed"))
+				So(string(msg.Data), ShouldEqual, string(expected))
+				So(string(msg.Data), ShouldStartWith, `{"_batch_id":"test","_type":"aws","_uuid":"test","action":"delete"`)
+				So(string(msg.Data), ShouldContainSubstring, `"outcome":"completed"`)
+				So(string(msg.Data), ShouldContainSubstring, `"timestamp":"2016-10-01T00:00:00Z"`)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			now = time.Now
+		})
+	})
+}
+
+func TestAuditRecordFields(t *testing.T) {
+	Convey("Given an event with credentials and rules", t, func() {
+		cfg := defaultConfig()
+		e := testEvent
+		e.cfg = cfg
+		e.DatacenterExternalID = "external"
+		e.DatacenterAssumeRoleARN = "arn:aws:iam::123456789012:role/deleter"
+		buildTestRules(&e)
+
+		Convey("When building its audit record", func() {
+			record := auditRecord(&e, "completed")
+
+			Convey("It should strip the credentials and keep the identity", func() {
+				So(record, ShouldNotContainKey, "datacenter_secret")
+				So(record, ShouldNotContainKey, "datacenter_token")
+				So(record, ShouldNotContainKey, "datacenter_external_id")
+				So(record["datacenter_assume_role_arn"], ShouldEqual, "arn:aws:iam::123456789012:role/deleter")
+				So(record["_uuid"], ShouldEqual, "test")
+				So(record["action"], ShouldEqual, "delete")
+			})
+
+			Convey("It should keep the rules", func() {
+				So(record, ShouldContainKey, "security_group_rules")
+				So(record, ShouldNotContainKey, "rule_counts")
+			})
+		})
+
+		Convey("When rules are omitted from audit records", func() {
+			cfg.AuditOmitRules = true
+			e.SecurityGroupRules.Ingress = append(e.SecurityGroupRules.Ingress, e.SecurityGroupRules.Ingress[0])
+			data, _ := canonicalJSON(auditRecord(&e, "completed"))
+
+			Convey("It should only keep their count", func() {
+				So(string(data), ShouldNotContainSubstring, "security_group_rules")
+				So(string(data), ShouldNotContainSubstring, "10.0.10.100/32")
+				So(string(data), ShouldContainSubstring, `"rule_counts":{"egress":1,"ingress":2}`)
+				So(string(data), ShouldNotContainSubstring, `"key"`)
+				So(string(data), ShouldContainSubstring, `"_uuid":"test"`)
+			})
+		})
+	})
+}
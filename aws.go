@@ -0,0 +1,385 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var (
+	ErrENINotFound    = errors.New("Network interface not found")
+	ErrENIVPCMismatch = errors.New("Network interface does not belong to the datacenter VPC")
+	ErrENINoGroup     = errors.New("Network interface has no deletable security group")
+	ErrEmptyResponse  = errors.New("AWS returned an empty response")
+	ErrSGVPCMismatch  = errors.New("Security Group does not belong to the datacenter VPC")
+)
+
+// ec2Client is the subset of the EC2 api used by the connector
+type ec2Client interface {
+	DeleteSecurityGroupWithContext(aws.Context, *ec2.DeleteSecurityGroupInput, ...request.Option) (*ec2.DeleteSecurityGroupOutput, error)
+	DescribeNetworkInterfacesWithContext(aws.Context, *ec2.DescribeNetworkInterfacesInput, ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error)
+	DescribeSecurityGroupsWithContext(aws.Context, *ec2.DescribeSecurityGroupsInput, ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error)
+	RevokeSecurityGroupIngressWithContext(aws.Context, *ec2.RevokeSecurityGroupIngressInput, ...request.Option) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	RevokeSecurityGroupEgressWithContext(aws.Context, *ec2.RevokeSecurityGroupEgressInput, ...request.Option) (*ec2.RevokeSecurityGroupEgressOutput, error)
+}
+
+// partitions are the aws partitions an event can name
+var partitions = map[string]endpoints.Partition{
+	"aws":        endpoints.AwsPartition(),
+	"aws-us-gov": endpoints.AwsUsGovPartition(),
+	"aws-cn":     endpoints.AwsCnPartition(),
+}
+
+// resolverFor resolves endpoints in the event's partition when it names
+// one, otherwise inferring the partition from the region
+func resolverFor(ev *Event) endpoints.Resolver {
+	if p, ok := partitions[ev.DatacenterPartition]; ok {
+		return p
+	}
+	return endpoints.DefaultResolver()
+}
+
+// awsConfig builds the aws configuration for an event's datacenter. The
+// sdk's own retries are disabled, the retry middleware being the only
+// layer retrying calls.
+func awsConfig(ev *Event) *aws.Config {
+	return &aws.Config{
+		MaxRetries:       aws.Int(0),
+		Region:           aws.String(ev.DatacenterRegion),
+		Credentials:      credentialsFor(ev),
+		HTTPClient:       ev.cfg.httpClient,
+		EndpointResolver: resolverFor(ev),
+	}
+}
+
+// clientSlots bounds how many ec2 clients are live at once, nil means unbounded
+var clientSlots chan struct{}
+
+// reservedSlot is an extra slot only high priority events may use
+var reservedSlot chan struct{}
+
+// setMaxClients caps the number of concurrently live ec2 clients, zero
+// removes the cap
+func setMaxClients(n int) {
+	clientSlots = nil
+	reservedSlot = nil
+	if n > 0 {
+		clientSlots = make(chan struct{}, n)
+		reservedSlot = make(chan struct{}, 1)
+	}
+}
+
+// acquireClient blocks until a client can be created, returning a func
+// that frees the slot once the client is no longer used. High priority
+// events may also take the reserved slot, so one running on the reserved
+// worker doesn't wait for a client held by normal events.
+func acquireClient(priority bool) func() {
+	slots := clientSlots
+	if slots == nil {
+		return func() {}
+	}
+
+	if !priority {
+		slots <- struct{}{}
+		return func() {
+			<-slots
+		}
+	}
+
+	reserved := reservedSlot
+	select {
+	case slots <- struct{}{}:
+		return func() {
+			<-slots
+		}
+	case reserved <- struct{}{}:
+		return func() {
+			<-reserved
+		}
+	}
+}
+
+// ec2Config builds the aws configuration for ec2 calls, applying any
+// endpoint and signing region overrides
+func ec2Config(ev *Event) *aws.Config {
+	cfg := awsConfig(ev)
+	endpoint, signingRegion, resolver := ev.cfg.EC2Endpoint, ev.cfg.EC2SigningRegion, cfg.EndpointResolver
+	if endpoint == "" && signingRegion == "" {
+		return cfg
+	}
+
+	cfg.EndpointResolver = endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		resolved, err := resolver.EndpointFor(service, region, opts...)
+		if err != nil || service != ec2.EndpointsID {
+			return resolved, err
+		}
+
+		if endpoint != "" {
+			resolved.URL = endpoint
+		}
+		if signingRegion != "" {
+			resolved.SigningRegion = signingRegion
+			resolved.SigningMethod = "v4"
+		}
+
+		return resolved, nil
+	})
+
+	return cfg
+}
+
+// newClientToken generates a random id for an event's aws calls
+func newClientToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// withClientToken adds the token to a call's user agent, which
+// cloudtrail records, so the call can be matched to the event's result
+func withClientToken(token string) request.Option {
+	return request.WithAppendUserAgent("client-request-token/" + token)
+}
+
+// newEC2Client builds the client used to process an event
+var newEC2Client = func(ev *Event) ec2Client {
+	return ec2.New(session.New(), ec2Config(ev))
+}
+
+// discoverGroup finds the non-default security group attached to the
+// event's network interface
+func (d *deletion) discoverGroup() (string, error) {
+	req := ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: []*string{aws.String(d.ev.NetworkInterfaceID)},
+	}
+
+	var resp *ec2.DescribeNetworkInterfacesOutput
+	err := d.call("DescribeNetworkInterfaces", func(ctx aws.Context) (err error) {
+		resp, err = d.svc.DescribeNetworkInterfacesWithContext(ctx, &req)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp == nil {
+		return "", ErrEmptyResponse
+	}
+
+	if len(resp.NetworkInterfaces) != 1 || resp.NetworkInterfaces[0] == nil {
+		return "", ErrENINotFound
+	}
+
+	eni := resp.NetworkInterfaces[0]
+	if aws.StringValue(eni.VpcId) != d.ev.VPCID {
+		return "", ErrENIVPCMismatch
+	}
+
+	var groups []string
+	for _, g := range eni.Groups {
+		if g == nil || aws.StringValue(g.GroupName) == "default" {
+			continue
+		}
+		groups = append(groups, aws.StringValue(g.GroupId))
+	}
+
+	switch len(groups) {
+	case 0:
+		return "", ErrENINoGroup
+	case 1:
+		return groups[0], nil
+	}
+
+	return "", fmt.Errorf("Network interface has multiple security groups attached: %s", strings.Join(groups, ", "))
+}
+
+// errorCode returns the aws error code of an error, if any
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// isUnauthorized checks if aws refused a call for lack of permissions
+func isUnauthorized(err error) bool {
+	return errorCode(err) == "UnauthorizedOperation"
+}
+
+// resultCode returns the error code published for a failed event
+func resultCode(err error) string {
+	switch {
+	case isUnauthorized(err):
+		return "unauthorized"
+	case err == ErrRetryExhausted:
+		return "retry_exhausted"
+	case err == ErrCallTimeout:
+		return "timeout"
+	}
+	return errorCode(err)
+}
+
+// errorCategory classifies a failure while deleting: the checks
+// refusing to delete a group are validation errors, anything else
+// failed talking to aws
+func errorCategory(err error) string {
+	switch err {
+	case ErrSGProtected, ErrSGVPCMismatch, ErrENIVPCMismatch, ErrENINoGroup:
+		return categoryValidation
+	}
+	return categoryAWS
+}
+
+// isNotFound checks if an AWS error reports a missing security group
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == "InvalidGroup.NotFound"
+	}
+	return false
+}
+
+// isAbsent checks if deleting a group failed because it is already
+// gone: aws reports it not found or, when a previous delivery left the
+// id blank, malformed. Any other malformed id is a real error.
+func isAbsent(id string, err error) bool {
+	switch errorCode(err) {
+	case "InvalidGroup.NotFound":
+		return true
+	case "InvalidGroupId.Malformed":
+		return strings.TrimSpace(id) == ""
+	}
+	return false
+}
+
+// deletingCodes are the errors aws returns for a group that another
+// request is still deleting
+var deletingCodes = map[string]bool{
+	"IncorrectState": true,
+}
+
+// isDeleting checks if deleting a group failed because it is already
+// on its way out
+func isDeleting(err error) bool {
+	return deletingCodes[errorCode(err)]
+}
+
+// describeGroup fetches a security group, returning nil if it does not exist
+func (d *deletion) describeGroup(id string) (*ec2.SecurityGroup, error) {
+	req := ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{aws.String(id)},
+	}
+
+	var resp *ec2.DescribeSecurityGroupsOutput
+	err := d.call("DescribeSecurityGroups", func(ctx aws.Context) (err error) {
+		resp, err = d.svc.DescribeSecurityGroupsWithContext(ctx, &req)
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, ErrEmptyResponse
+	}
+
+	if len(resp.SecurityGroups) == 0 {
+		return nil, nil
+	}
+
+	return resp.SecurityGroups[0], nil
+}
+
+// group describes a security group once per deletion, so the checks
+// made before deleting it share a single call. With a DescribeCacheTTL
+// set, groups described for recent events are reused too.
+func (d *deletion) group(id string) (*ec2.SecurityGroup, error) {
+	d.mu.Lock()
+	sg, ok := d.described[id]
+	d.mu.Unlock()
+	if ok {
+		return sg, nil
+	}
+
+	key := cacheKey(d.ev.DatacenterRegion, id)
+	sg, ok = describeCache.get(key)
+	if !ok {
+		var err error
+		if sg, err = d.describeGroup(id); err != nil {
+			return nil, err
+		}
+		if sg != nil {
+			describeCache.put(key, sg, d.ev.cfg.DescribeCacheTTL, d.ev.cfg.DescribeCacheSize)
+		}
+	}
+
+	d.mu.Lock()
+	if d.described == nil {
+		d.described = make(map[string]*ec2.SecurityGroup)
+	}
+	d.described[id] = sg
+	d.mu.Unlock()
+
+	return sg, nil
+}
+
+// checkVPC refuses to delete a group that belongs to another VPC than
+// the event's, as the id would otherwise delete the wrong group
+func (d *deletion) checkVPC(id string) error {
+	if !d.ev.cfg.VerifyVPC {
+		return nil
+	}
+
+	sg, err := d.group(id)
+	if err != nil || sg == nil {
+		return err
+	}
+
+	if aws.StringValue(sg.VpcId) != d.ev.VPCID {
+		return ErrSGVPCMismatch
+	}
+
+	return nil
+}
+
+// groupAbsent checks if a security group can no longer be described
+func (d *deletion) groupAbsent(id string) (bool, error) {
+	sg, err := d.describeGroup(id)
+	return sg == nil && err == nil, err
+}
+
+// hasTag checks if a group carries a tag given as key=value, or just key
+// to match any value
+func hasTag(sg *ec2.SecurityGroup, tag string) bool {
+	parts := strings.SplitN(tag, "=", 2)
+
+	for _, t := range sg.Tags {
+		if t == nil || aws.StringValue(t.Key) != parts[0] {
+			continue
+		}
+		if len(parts) == 1 || aws.StringValue(t.Value) == parts[1] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,471 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeEC2 struct {
+	sync.Mutex
+	deleted    []string
+	deleteErr  error
+	nilOutput  bool
+	interfaces []*ec2.NetworkInterface
+
+	groups        []*ec2.SecurityGroup
+	describeErr   error
+	describeCalls int
+
+	revokeErrs  []error
+	revoked     []string
+	revokeCalls int
+}
+
+func (f *fakeEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.deleteErr != nil || f.nilOutput {
+		return nil, f.deleteErr
+	}
+	f.Lock()
+	f.deleted = append(f.deleted, aws.StringValue(in.GroupId))
+	f.Unlock()
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeNetworkInterfacesWithContext(ctx aws.Context, in *ec2.DescribeNetworkInterfacesInput, opts ...request.Option) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.nilOutput {
+		return nil, nil
+	}
+	return &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: f.interfaces}, nil
+}
+
+func (f *fakeEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, in *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.describeCalls++
+	if f.describeErr != nil {
+		return nil, f.describeErr
+	}
+	if len(in.GroupIds) == 0 {
+		return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: f.groups}, nil
+	}
+
+	var groups []*ec2.SecurityGroup
+	for _, sg := range f.groups {
+		for _, id := range in.GroupIds {
+			if aws.StringValue(sg.GroupId) == aws.StringValue(id) {
+				groups = append(groups, sg)
+			}
+		}
+	}
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: groups}, nil
+}
+
+// revoke records a revoke call, failing with the next queued error if any
+func (f *fakeEC2) revoke(kind string, perms []*ec2.IpPermission) error {
+	f.Lock()
+	defer f.Unlock()
+	f.revokeCalls++
+	if len(f.revokeErrs) > 0 {
+		err := f.revokeErrs[0]
+		f.revokeErrs = f.revokeErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range perms {
+		for _, r := range p.IpRanges {
+			f.revoked = append(f.revoked, kind+":"+aws.StringValue(r.CidrIp))
+		}
+		for _, r := range p.Ipv6Ranges {
+			f.revoked = append(f.revoked, kind+":"+aws.StringValue(r.CidrIpv6))
+		}
+	}
+	return nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngressWithContext(ctx aws.Context, in *ec2.RevokeSecurityGroupIngressInput, opts ...request.Option) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	return &ec2.RevokeSecurityGroupIngressOutput{}, f.revoke("ingress", in.IpPermissions)
+}
+
+func (f *fakeEC2) RevokeSecurityGroupEgressWithContext(ctx aws.Context, in *ec2.RevokeSecurityGroupEgressInput, opts ...request.Option) (*ec2.RevokeSecurityGroupEgressOutput, error) {
+	return &ec2.RevokeSecurityGroupEgressOutput{}, f.revoke("egress", in.IpPermissions)
+}
+
+// useFakeEC2 swaps the client factory for a fake, returning a restore func
+func useFakeEC2(f ec2Client) func() {
+	original := newEC2Client
+	newEC2Client = func(ev *Event) ec2Client {
+		return f
+	}
+	return func() {
+		newEC2Client = original
+	}
+}
+
+func testENI(vpc string, groups ...string) *ec2.NetworkInterface {
+	eni := &ec2.NetworkInterface{
+		NetworkInterfaceId: aws.String("eni-0000000"),
+		VpcId:              aws.String(vpc),
+	}
+	for _, g := range groups {
+		eni.Groups = append(eni.Groups, &ec2.GroupIdentifier{
+			GroupId:   aws.String(g),
+			GroupName: aws.String(g),
+		})
+	}
+	return eni
+}
+
+func TestDeleteFirewall(t *testing.T) {
+	Convey("Given an event for a security group", t, func() {
+		ev := testEvent
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When the deletion succeeds", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete the event's group", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When aws rejects the deletion", func() {
+			failure := errors.New("boom")
+			fake.deleteErr = failure
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should return the aws error", func() {
+				So(err, ShouldEqual, failure)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+func TestENIDiscovery(t *testing.T) {
+	Convey("Given an event with only a network interface id", t, func() {
+		ev := testEvent
+		ev.SecurityGroupAWSID = ""
+		ev.NetworkInterfaceID = "eni-0000000"
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When validating the event", func() {
+			err := ev.Validate()
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the interface has a single non-default group", func() {
+			fake.interfaces = []*ec2.NetworkInterface{testENI("vpc-0000000", "default", "sg-0000001")}
+			_, err := deleteFirewall(&ev)
+			Convey("It should delete the discovered group", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000001"})
+				So(ev.SecurityGroupAWSID, ShouldEqual, "sg-0000001")
+			})
+		})
+
+		Convey("When the interface has multiple non-default groups", func() {
+			fake.interfaces = []*ec2.NetworkInterface{testENI("vpc-0000000", "sg-0000001", "sg-0000002")}
+			_, err := deleteFirewall(&ev)
+			Convey("It should error without deleting", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "Network interface has multiple security groups attached: sg-0000001, sg-0000002")
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the interface only has the default group", func() {
+			fake.interfaces = []*ec2.NetworkInterface{testENI("vpc-0000000", "default")}
+			_, err := deleteFirewall(&ev)
+			Convey("It should error without deleting", func() {
+				So(err, ShouldEqual, ErrENINoGroup)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the interface belongs to another vpc", func() {
+			fake.interfaces = []*ec2.NetworkInterface{testENI("vpc-1111111", "sg-0000001")}
+			_, err := deleteFirewall(&ev)
+			Convey("It should error without deleting", func() {
+				So(err, ShouldEqual, ErrENIVPCMismatch)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the interface does not exist", func() {
+			_, err := deleteFirewall(&ev)
+			Convey("It should error without deleting", func() {
+				So(err, ShouldEqual, ErrENINotFound)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+func TestEmptyResponses(t *testing.T) {
+	Convey("Given an ec2 api returning no output and no error", t, func() {
+		ev := testEvent
+		fake := &fakeEC2{nilOutput: true}
+		restore := useFakeEC2(fake)
+
+		Convey("When deleting a security group", func() {
+			_, err := deleteFirewall(&ev)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrEmptyResponse)
+			})
+		})
+
+		Convey("When discovering a group from a network interface", func() {
+			ev.SecurityGroupAWSID = ""
+			ev.NetworkInterfaceID = "eni-0000000"
+			_, err := deleteFirewall(&ev)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrEmptyResponse)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+type slowEC2 struct {
+	fakeEC2
+	live *int64
+}
+
+func (f *slowEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	time.Sleep(10 * time.Millisecond)
+	defer atomic.AddInt64(f.live, -1)
+	return f.fakeEC2.DeleteSecurityGroupWithContext(ctx, in)
+}
+
+func TestClientCap(t *testing.T) {
+	Convey("Given a cap on live ec2 clients", t, func() {
+		setMaxClients(2)
+
+		var live, peak int64
+		var mu sync.Mutex
+		original := newEC2Client
+		newEC2Client = func(ev *Event) ec2Client {
+			n := atomic.AddInt64(&live, 1)
+			mu.Lock()
+			if n > peak {
+				peak = n
+			}
+			mu.Unlock()
+			return &slowEC2{live: &live}
+		}
+
+		Convey("When many events are processed concurrently", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ev := testEvent
+					deleteFirewall(&ev)
+				}()
+			}
+			wg.Wait()
+
+			Convey("It should never have more clients live than the cap", func() {
+				So(peak, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When every slot is taken by normal events", func() {
+			r1 := acquireClient(false)
+			r2 := acquireClient(false)
+
+			acquired := make(chan func(), 1)
+			go func() {
+				acquired <- acquireClient(true)
+			}()
+
+			var release func()
+			select {
+			case release = <-acquired:
+				release()
+			case <-time.After(time.Second):
+			}
+			r1()
+			r2()
+
+			Convey("It should let a high priority event use the reserved slot", func() {
+				So(release, ShouldNotBeNil)
+			})
+		})
+
+		Reset(func() {
+			setMaxClients(0)
+			newEC2Client = original
+		})
+	})
+}
+
+func TestEC2Endpoint(t *testing.T) {
+	Convey("Given an ec2 vpc endpoint with its own signing region", t, func() {
+		cfg := defaultConfig()
+		cfg.EC2Endpoint = "https://vpce-0000000.ec2.eu-west-1.vpce.amazonaws.com"
+		cfg.EC2SigningRegion = "eu-west-2"
+		ev := testEvent
+		ev.cfg = cfg
+
+		Convey("When building an ec2 client", func() {
+			svc := newEC2Client(&ev).(*ec2.EC2)
+
+			Convey("It should call the endpoint and sign for the configured region", func() {
+				So(svc.Endpoint, ShouldEqual, "https://vpce-0000000.ec2.eu-west-1.vpce.amazonaws.com")
+				So(svc.SigningRegion, ShouldEqual, "eu-west-2")
+				So(aws.StringValue(svc.Config.Region), ShouldEqual, "eu-west-1")
+			})
+		})
+
+		Convey("When no override is set", func() {
+			cfg.EC2Endpoint = ""
+			cfg.EC2SigningRegion = ""
+			svc := newEC2Client(&ev).(*ec2.EC2)
+
+			Convey("It should use the regional endpoint", func() {
+				So(svc.Endpoint, ShouldEqual, "https://ec2.eu-west-1.amazonaws.com")
+				So(svc.SigningRegion, ShouldEqual, "eu-west-1")
+			})
+		})
+	})
+}
+
+func TestSDKRetries(t *testing.T) {
+	Convey("Given an event", t, func() {
+		ev := testEvent
+		ev.cfg = defaultConfig()
+
+		Convey("When building an ec2 client", func() {
+			svc := newEC2Client(&ev).(*ec2.EC2)
+
+			Convey("It should leave retrying to the middleware", func() {
+				So(aws.IntValue(svc.Config.MaxRetries), ShouldEqual, 0)
+				So(svc.Client.Retryer.MaxRetries(), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestClientRequestToken(t *testing.T) {
+	Convey("Given an ec2 endpoint recording user agents", t, func() {
+		cfg := defaultConfig()
+		cfg.VerifyVPC = false
+		agents := make(chan string, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agents <- r.Header.Get("User-Agent")
+			w.Write([]byte(`<DeleteSecurityGroupResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>test</requestId><return>true</return></DeleteSecurityGroupResponse>`))
+		}))
+		cfg.EC2Endpoint = srv.URL
+
+		Convey("When deleting a security group", func() {
+			ev := testEvent
+			ev.cfg = cfg
+			res, err := deleteFirewall(&ev)
+			ev.apply(res)
+
+			Convey("It should send the token with the call and mirror it on the result", func() {
+				So(err, ShouldBeNil)
+				So(ev.ClientRequestToken, ShouldHaveLength, 36)
+				So(<-agents, ShouldEndWith, " client-request-token/"+ev.ClientRequestToken)
+			})
+		})
+
+		Convey("When deleting two events", func() {
+			ev1, ev2 := testEvent, testEvent
+			ev1.cfg, ev2.cfg = cfg, cfg
+			res1, _ := deleteFirewall(&ev1)
+			res2, _ := deleteFirewall(&ev2)
+
+			Convey("It should give each a different token", func() {
+				So(res1.ClientRequestToken, ShouldNotEqual, res2.ClientRequestToken)
+			})
+		})
+
+		Reset(func() {
+			srv.Close()
+		})
+	})
+}
+
+func TestPartitions(t *testing.T) {
+	Convey("Given events naming a partition", t, func() {
+		tests := []struct {
+			partition, region, endpoint string
+		}{
+			{"aws", "eu-west-1", "https://ec2.eu-west-1.amazonaws.com"},
+			{"aws-us-gov", "us-gov-west-1", "https://ec2.us-gov-west-1.amazonaws.com"},
+			{"aws-cn", "cn-north-1", "https://ec2.cn-north-1.amazonaws.com.cn"},
+			{"aws-cn", "cn-new-1", "https://ec2.cn-new-1.amazonaws.com.cn"},
+			{"", "cn-north-1", "https://ec2.cn-north-1.amazonaws.com.cn"},
+		}
+
+		Convey("When building their ec2 clients", func() {
+			Convey("It should resolve endpoints in the named partition", func() {
+				for _, tt := range tests {
+					ev := testEvent
+					ev.DatacenterPartition = tt.partition
+					ev.DatacenterRegion = tt.region
+
+					So(ev.Validate(), ShouldBeNil)
+					So(newEC2Client(&ev).(*ec2.EC2).Endpoint, ShouldEqual, tt.endpoint)
+				}
+			})
+		})
+
+		Convey("When the partition overrides the region's", func() {
+			ev := testEvent
+			ev.DatacenterPartition = "aws-cn"
+			svc := newEC2Client(&ev).(*ec2.EC2)
+
+			Convey("It should use the partition's domain", func() {
+				So(svc.Endpoint, ShouldEqual, "https://ec2.eu-west-1.amazonaws.com.cn")
+			})
+		})
+
+		Convey("When the partition is unknown", func() {
+			ev := testEvent
+			ev.DatacenterPartition = "aws-iso"
+
+			Convey("It should fail validation", func() {
+				So(ev.Validate(), ShouldEqual, ErrDatacenterPartitionInvalid)
+			})
+		})
+	})
+}
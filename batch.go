@@ -0,0 +1,103 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// groupResult is the outcome of deleting one group of a batch
+type groupResult struct {
+	SecurityGroupAWSID string `json:"security_group_aws_id"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Error              string `json:"error,omitempty"`
+}
+
+// deleteBatch deletes every group listed on the event concurrently,
+// recording a result for each id in the order the ids were given.
+// Repeated ids are only deleted once.
+func (d *deletion) deleteBatch() error {
+	ev := d.ev
+	ids := ev.SecurityGroupAWSIDs
+	results := make([]groupResult, len(ids))
+	seen := make(map[string]bool)
+	var unique []string
+
+	slots := make(chan struct{}, ev.cfg.batchConcurrency())
+	var wg sync.WaitGroup
+
+	for i, id := range ids {
+		results[i] = groupResult{SecurityGroupAWSID: id, Status: statusDeleted}
+
+		if seen[id] {
+			results[i].Status = statusSkipped
+			results[i].Reason = "duplicate"
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(r *groupResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			d.deleteBatchGroup(r)
+		}(&results[i])
+	}
+
+	wg.Wait()
+
+	if ev.cfg.ReconcileBatches {
+		d.reconcile(unique)
+	}
+
+	ev.Results = results
+	d.result.DeletedIDs = nil
+
+	failed := 0
+	for _, r := range results {
+		switch r.Status {
+		case statusDeleted:
+			d.result.DeletedIDs = append(d.result.DeletedIDs, r.SecurityGroupAWSID)
+		case statusFailed, statusProtected:
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d security groups could not be deleted", failed, len(seen))
+	}
+
+	return nil
+}
+
+// deleteBatchGroup deletes one group of a batch, filling in its result
+func (d *deletion) deleteBatchGroup(r *groupResult) {
+	id := r.SecurityGroupAWSID
+
+	err := d.deleteGroup(id)
+	switch {
+	case err == ErrSGProtected:
+		r.Status = statusProtected
+		r.Error = err.Error()
+	case err != nil:
+		r.Status = statusFailed
+		r.Error = err.Error()
+	case d.wasAlreadyDeleted(id):
+		r.Status = statusAlreadyAbsent
+	}
+}
+
+// batchConcurrency is how many groups of a batch are deleted at once,
+// at least one
+func (c *Config) batchConcurrency() int {
+	if c.BatchConcurrency < 1 {
+		return 1
+	}
+	return c.BatchConcurrency
+}
@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatchDelete(t *testing.T) {
+	Convey("Given a batch event with repeated ids", t, func() {
+		ev := testEvent
+		ev.SecurityGroupAWSID = ""
+		ev.SecurityGroupAWSIDs = []string{"sg-0000001", "sg-0000002", "sg-0000001"}
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When validating the event", func() {
+			err := ev.Validate()
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When deleting the batch", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete each id once", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldHaveLength, 2)
+				So(fake.deleted, ShouldContain, "sg-0000001")
+				So(fake.deleted, ShouldContain, "sg-0000002")
+			})
+
+			Convey("It should report the duplicate as a no-op", func() {
+				So(len(ev.Results), ShouldEqual, 3)
+				So(ev.Results[0].Status, ShouldEqual, "deleted")
+				So(ev.Results[1].Status, ShouldEqual, "deleted")
+				So(ev.Results[2].SecurityGroupAWSID, ShouldEqual, "sg-0000001")
+				So(ev.Results[2].Status, ShouldEqual, "skipped")
+				So(ev.Results[2].Reason, ShouldEqual, "duplicate")
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+// delayedEC2 takes longer to delete some groups than others
+type delayedEC2 struct {
+	fakeEC2
+	delays map[string]time.Duration
+}
+
+func (f *delayedEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	time.Sleep(f.delays[aws.StringValue(in.GroupId)])
+	return f.fakeEC2.DeleteSecurityGroupWithContext(ctx, in)
+}
+
+func TestBatchOrder(t *testing.T) {
+	Convey("Given a batch whose first groups take longest to delete", t, func() {
+		ev := testEvent
+		ev.SecurityGroupAWSID = ""
+		ev.SecurityGroupAWSIDs = []string{"sg-0000001", "sg-0000002", "sg-0000003"}
+		fake := &delayedEC2{delays: map[string]time.Duration{
+			"sg-0000001": 40 * time.Millisecond,
+			"sg-0000002": 20 * time.Millisecond,
+		}}
+		restore := useFakeEC2(fake)
+
+		Convey("When deleting the batch", func() {
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should finish them out of order", func() {
+				So(fake.deleted, ShouldResemble, []string{"sg-0000003", "sg-0000002", "sg-0000001"})
+			})
+
+			Convey("It should report results in the order of the ids", func() {
+				So(err, ShouldBeNil)
+				So(ev.Results, ShouldHaveLength, 3)
+				for i, id := range ev.SecurityGroupAWSIDs {
+					So(ev.Results[i].SecurityGroupAWSID, ShouldEqual, id)
+					So(ev.Results[i].Status, ShouldEqual, "deleted")
+				}
+				So(res.DeletedIDs, ShouldResemble, ev.SecurityGroupAWSIDs)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+func TestReconcileBatches(t *testing.T) {
+	testSetup()
+
+	Convey("Given batches are reconciled", t, func() {
+		cfg := defaultConfig()
+		cfg.ReconcileBatches = true
+		reconciled := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("firewall.delete.aws.reconcile", reconciled)
+
+		ev := testEvent
+		ev.cfg = cfg
+		ev.SecurityGroupAWSID = ""
+		ev.SecurityGroupAWSIDs = []string{"sg-0000001", "sg-0000002", "sg-0000001"}
+		fake := &fakeEC2{groups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-0000002"), VpcId: aws.String("vpc-0000000")},
+		}}
+		restore := useFakeEC2(fake)
+
+		Convey("When a group survives its deletion", func() {
+			_, err := deleteFirewall(&ev)
+			msg, timeout := waitMsg(reconciled)
+
+			Convey("It should report it as a survivor", func() {
+				So(err, ShouldBeNil)
+				So(timeout, ShouldBeNil)
+				var r reconciliation
+				So(json.Unmarshal(msg.Data, &r), ShouldBeNil)
+				So(r.UUID, ShouldEqual, "test")
+				So(r.SecurityGroupAWSIDs, ShouldResemble, []string{"sg-0000001", "sg-0000002"})
+				So(r.Survivors, ShouldResemble, []string{"sg-0000002"})
+				So(r.Unchecked, ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			restore()
+		})
+	})
+}
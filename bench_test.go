@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// benchRuleSets are the rule set sizes benchmarked: a typical event and
+// one with as many rules as a group can hold
+var benchRuleSets = []struct {
+	name  string
+	rules int
+}{
+	{"typical", 4},
+	{"large", 120},
+}
+
+// benchEvent builds a valid event with n ingress and n egress rules
+func benchEvent(n int) Event {
+	ev := testEvent
+	ev.SecurityGroupRules.Ingress = nil
+	ev.SecurityGroupRules.Egress = nil
+
+	for i := 0; i < n; i++ {
+		r := rule{
+			IP:       fmt.Sprintf("10.0.%d.%d/32", i/250, i%250),
+			FromPort: int64(1000 + i),
+			ToPort:   int64(1000 + i),
+			Protocol: "tcp",
+		}
+		ev.SecurityGroupRules.Ingress = append(ev.SecurityGroupRules.Ingress, r)
+		ev.SecurityGroupRules.Egress = append(ev.SecurityGroupRules.Egress, r)
+	}
+
+	return ev
+}
+
+func BenchmarkProcess(b *testing.B) {
+	for _, set := range benchRuleSets {
+		data, _ := json.Marshal(benchEvent(set.rules))
+
+		b.Run(set.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ev := Event{cfg: defaultConfig()}
+				if err := ev.Process(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	for _, set := range benchRuleSets {
+		ev := benchEvent(set.rules)
+
+		b.Run(set.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := ev.Validate(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDeleteFirewall(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stdout)
+
+	revoke := true
+
+	for _, set := range benchRuleSets {
+		template := benchEvent(set.rules)
+		template.Revoke = &revoke
+
+		b.Run(set.name, func(b *testing.B) {
+			restore := useFakeEC2(&fakeEC2{})
+			defer restore()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ev := template
+				if _, err := deleteFirewall(&ev); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var describeCache = newGroupCache()
+
+// groupCache keeps recently described groups, dropping the least
+// recently used one when full
+type groupCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedGroup struct {
+	key     string
+	group   *ec2.SecurityGroup
+	expires time.Time
+}
+
+func newGroupCache() *groupCache {
+	return &groupCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey identifies a group within its region
+func cacheKey(region, id string) string {
+	return region + "/" + id
+}
+
+// get returns a cached group that has not expired
+func (c *groupCache) get(key string) (*ec2.SecurityGroup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cachedGroup)
+	if now().After(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return entry.group, true
+}
+
+// put caches a group for ttl, keeping at most size groups
+func (c *groupCache) put(key string, sg *ec2.SecurityGroup, ttl time.Duration, size int) {
+	if ttl <= 0 || size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedGroup{key: key, group: sg, expires: now().Add(ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedGroup).key)
+	}
+}
+
+// forget drops a group, once it has been deleted
+func (c *groupCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,99 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDescribeCache(t *testing.T) {
+	Convey("Given a describe cache", t, func() {
+		cfg := defaultConfig()
+		cfg.DescribeCacheTTL = time.Minute
+		clock := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+		now = func() time.Time { return clock }
+		describeCache = newGroupCache()
+
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &fakeEC2{groups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}}}
+		check := func() error {
+			d := &deletion{ctx: context.Background(), ev: &ev, svc: fake, result: &DeleteResult{}}
+			return d.checkVPC("sg-0000000")
+		}
+
+		Convey("When a group is checked twice within the ttl", func() {
+			So(check(), ShouldBeNil)
+			So(check(), ShouldBeNil)
+
+			Convey("It should describe it once", func() {
+				So(fake.describeCalls, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the ttl has passed", func() {
+			So(check(), ShouldBeNil)
+			clock = clock.Add(2 * time.Minute)
+			So(check(), ShouldBeNil)
+
+			Convey("It should describe it again", func() {
+				So(fake.describeCalls, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the cache is disabled", func() {
+			cfg.DescribeCacheTTL = 0
+			So(check(), ShouldBeNil)
+			So(check(), ShouldBeNil)
+
+			Convey("It should describe it every time", func() {
+				So(fake.describeCalls, ShouldEqual, 2)
+			})
+		})
+
+		Convey("When more groups than the size are cached", func() {
+			for _, id := range []string{"sg-1", "sg-2", "sg-3"} {
+				describeCache.put(id, &ec2.SecurityGroup{GroupId: aws.String(id)}, cfg.DescribeCacheTTL, 2)
+			}
+
+			Convey("It should drop the least recently used", func() {
+				_, ok := describeCache.get("sg-1")
+				So(ok, ShouldBeFalse)
+				_, ok = describeCache.get("sg-3")
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Convey("When used concurrently", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					check()
+				}()
+			}
+			wg.Wait()
+
+			Convey("It should keep the group cached", func() {
+				_, ok := describeCache.get(cacheKey("eu-west-1", "sg-0000000"))
+				So(ok, ShouldBeTrue)
+			})
+		})
+
+		Reset(func() {
+			now = time.Now
+			describeCache = newGroupCache()
+		})
+	})
+}
@@ -0,0 +1,683 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the connector settings, read once from the environment
+// at startup and passed to everything that needs them
+type Config struct {
+	NatsURI   string
+	LogOutput string
+	// TLSMinVersion is the lowest tls version negotiated with nats and aws
+	TLSMinVersion uint16
+
+	// DonePayload controls what is published on completion: full,
+	// minimal or empty
+	DonePayload string
+	// ExplicitResultFields always includes the error and status keys on
+	// full done payloads, even when empty
+	ExplicitResultFields bool
+	// ErrorSubject receives events that failed while being processed
+	ErrorSubject string
+	// ValidationErrorSubject receives events that failed validation
+	ValidationErrorSubject string
+	// DoneSubject receives successfully processed events
+	DoneSubject string
+	// DeadLetterSubject receives messages that are rejected before being read
+	DeadLetterSubject string
+	// ExplainSubject receives the traces of events asking for an explanation
+	ExplainSubject string
+	// PlanSubject receives the plans of batches waiting for confirmation
+	PlanSubject string
+	// ObserveSubject receives the results of events handled observe only
+	ObserveSubject string
+	// MaxPayloadBytes rejects larger events before they are unmarshaled.
+	// Zero disables the limit.
+	MaxPayloadBytes int
+	// ResultShards spreads done results across this many subjects, keyed
+	// by event uuid. Zero or one keeps a single subject.
+	ResultShards int
+	// ResultMetadata is merged into the metadata of every published result
+	ResultMetadata map[string]string
+	// ResultSinks are the destinations every terminal result is sent to:
+	// nats, webhook, stdout, file and mirror. Replies, audit records and
+	// dead letters only go to nats.
+	ResultSinks []string
+	// ResultLogFile appends every terminal result to this file as one
+	// json line. Empty disables the file sink.
+	ResultLogFile string
+	// ResultLogMaxBytes is the size past which the result log is rotated
+	// to ResultLogFile.1, replacing the previous one
+	ResultLogMaxBytes int
+	// MirrorNatsURI also publishes every terminal result to a second
+	// nats cluster, on the same subjects. Empty disables the mirror sink.
+	MirrorNatsURI string
+	// ResultSpool keeps unpublished results in this file so they survive
+	// a restart while nats is unavailable. Empty keeps them in memory only.
+	ResultSpool string
+	// PendingResultsLimit caps how many unpublished results are kept
+	// while the nats connection is down
+	PendingResultsLimit int
+	// RedialAttempts is how many times a closed nats connection is
+	// re-established to publish a result before it is buffered
+	RedialAttempts int
+	// RedialDelay is the wait between attempts to re-establish the connection
+	RedialDelay time.Duration
+
+	// AuditSubject receives an audit record for every processed event,
+	// auditing is disabled when empty
+	AuditSubject string
+	// AuditOmitRules replaces the rules of audit records with their count
+	AuditOmitRules bool
+	// HeartbeatSubject receives periodic liveness messages, empty disables them
+	HeartbeatSubject string
+	// HeartbeatInterval is the time between heartbeats
+	HeartbeatInterval time.Duration
+	// WebhookURL receives a POST of every terminal result, empty disables it
+	WebhookURL string
+	// WebhookSecret signs webhook bodies in the X-Signature header
+	WebhookSecret string
+	// WebhookTimeout bounds the delivery of a result to the webhook,
+	// retries included
+	WebhookTimeout time.Duration
+	// WebhookAttempts is how many times a failed webhook is tried
+	WebhookAttempts int
+	// MetricsAddr serves /metrics and /healthz, empty disables the endpoint
+	MetricsAddr string
+	// StrictListeners fails startup when the endpoint can't be served
+	// instead of carrying on without it
+	StrictListeners bool
+
+	// CallTimeout bounds each individual aws call, zero leaves calls
+	// bounded only by the event's context
+	CallTimeout time.Duration
+	// EventTimeout bounds the whole processing of an event, retries and
+	// waits included, zero leaves it unbounded
+	EventTimeout time.Duration
+	// RetryAttempts is how many times a retryable aws call is tried
+	RetryAttempts int
+	// RetryBaseDelay is the wait before the first retry, doubling after
+	// each attempt
+	RetryBaseDelay time.Duration
+	// RetryJitter randomises retry delays so replicas don't retry in
+	// lockstep: full, equal or none
+	RetryJitter string
+	// PriorityRetryAttempts replaces RetryAttempts for high priority events
+	PriorityRetryAttempts int
+	// MaxEventAttempts caps the aws call attempts of a single event,
+	// retries of every operation included. Zero leaves it uncapped.
+	MaxEventAttempts int
+	// DependencyAttempts is how many times deleting a group still in use
+	// by a detaching interface or instance is tried
+	DependencyAttempts int
+	// DependencyDelay is the wait before the first retry of a group still
+	// in use, doubling after each attempt
+	DependencyDelay time.Duration
+	// MaxAWSClients caps the number of concurrently live ec2 clients,
+	// zero removes the cap
+	MaxAWSClients int
+	// EC2Endpoint sends ec2 calls to a custom endpoint, such as a vpc
+	// interface endpoint
+	EC2Endpoint string
+	// EC2SigningRegion signs ec2 calls for another region than the
+	// event's, for endpoints that expect it
+	EC2SigningRegion string
+
+	// AccessKeyFile is read when an event carries no access key
+	AccessKeyFile string
+	// AccessTokenFile is read when an event carries no access token
+	AccessTokenFile string
+	// RegionFile is read when an event carries no region
+	RegionFile string
+	// AssumeRoleRetry retries AccessDenied from assume-role, which newly
+	// created roles return until iam has propagated them
+	AssumeRoleRetry bool
+	// AssumeRoleAttempts is how many times assuming a role is tried
+	AssumeRoleAttempts int
+	// AssumeRoleDelay is the wait before the first assume-role retry,
+	// doubling after each attempt
+	AssumeRoleDelay time.Duration
+	// AssumeRoleWithKeys assumes the role of an event carrying both static
+	// keys and a role, signing the assume-role call with the keys
+	AssumeRoleWithKeys bool
+	// RegionCredentials maps a region to the credentials used for events
+	// in it that carry none of their own
+	RegionCredentials map[string]regionCredentials
+	// RegionOverride uses the region's credentials even when an event
+	// carries its own
+	RegionOverride bool
+	// IncludeCallerIdentity adds the deleting iam identity to results
+	IncludeCallerIdentity bool
+
+	// ObserveOnly validates and reports events without ever calling aws
+	ObserveOnly bool
+	// RequireName rejects events without a security group name
+	RequireName bool
+	// RequireRules rejects events with neither ingress nor egress rules.
+	// Otherwise they are allowed, and have nothing to revoke.
+	RequireRules bool
+	// StrictRulePorts rejects ports on rules whose protocol has none, as
+	// aws does, instead of ignoring them
+	StrictRulePorts bool
+	// AggregateRuleErrors reports every invalid rule at once instead of
+	// only the first one
+	AggregateRuleErrors bool
+	// DefaultVPCID is assumed for legacy events that omit their vpc id
+	DefaultVPCID string
+	// DeleteByName lets events without any id delete the group with
+	// their security_group_name
+	DeleteByName bool
+	// NameConflictPolicy decides what deleting by name does when several
+	// groups share the name: error, delete_all, or require_vpc to only
+	// delete the one in the event's VPC
+	NameConflictPolicy string
+
+	// VerifyVPC refuses to delete groups outside the event's VPC
+	VerifyVPC bool
+	// ProtectionTag blocks the deletion of any group carrying it, e.g.
+	// ernest:protected=true
+	ProtectionTag string
+	// CompareRules reports how the group's actual rules differ from the
+	// event's rules before deleting it
+	CompareRules bool
+	// RevokeBeforeDelete revokes the event's rules before deleting the group
+	RevokeBeforeDelete bool
+	// RevokeStrict fails the event when revoking its rules fails, instead
+	// of carrying on with the deletion
+	RevokeStrict bool
+	// RevokeChunkSize caps the rules revoked by a single aws call
+	RevokeChunkSize int
+	// Diagnostics looks up what still references a group when it can't
+	// be deleted
+	Diagnostics bool
+	// Workers is how many delete events are handled at once, at least
+	// one, with another worker reserved for high priority events
+	Workers int
+	// SerializeVPC deletes for one vpc at a time, so groups sharing
+	// dependencies within a vpc don't race, while the other workers
+	// carry on with other vpcs
+	SerializeVPC bool
+	// BatchConcurrency is how many groups of a batch are deleted at once
+	BatchConcurrency int
+	// ReconcileBatches describes every group of a batch once it has been
+	// processed and publishes the ones that still exist
+	ReconcileBatches bool
+	// ConfirmBatches makes batch events return a plan, deleting the
+	// groups only once a follow-up event confirms it by plan_id
+	ConfirmBatches bool
+	// PlanTTL is how long a batch plan waits for its confirmation
+	PlanTTL time.Duration
+	// ConfirmDelete requires the group to be reported missing before completing
+	ConfirmDelete bool
+	// ConfirmDeleteInterval is the wait between confirmation checks
+	ConfirmDeleteInterval time.Duration
+	// ConfirmDeleteTimeout bounds how long confirmation is polled for
+	ConfirmDeleteTimeout time.Duration
+	// ConfirmDeleteAbsences is how many checks in a row must find the
+	// group missing, so a flapping describe doesn't confirm too early
+	ConfirmDeleteAbsences int
+	// DescribeCacheTTL reuses described groups across events for this
+	// long, zero disables the cache
+	DescribeCacheTTL time.Duration
+	// DescribeCacheSize caps how many described groups are cached
+	DescribeCacheSize int
+
+	// Seen is the store of processed event uuids, nil disables dedup
+	Seen SeenStore
+	// SubjectPrefix namespaces the subjects the connector listens on
+	SubjectPrefix string
+	// DescribeHandler answers describe requests, the connector's read
+	// only path. Disabling it leaves the describe subject unsubscribed.
+	DescribeHandler bool
+	// ReprocessFailed keeps recently failed events so an operator can run
+	// them again with a retry command
+	ReprocessFailed bool
+	// ReprocessTTL is how long a failed event can be retried for
+	ReprocessTTL time.Duration
+	// ReprocessSize caps how many failed events are kept
+	ReprocessSize int
+	// MaxEvents makes the connector exit once it has handled this many
+	// events, zero runs forever
+	MaxEvents int
+	// IdleTimeout makes the connector exit when no event arrives for this
+	// long, zero runs forever
+	IdleTimeout time.Duration
+	// ShutdownGrace bounds how long the http endpoints get to finish
+	// requests in flight when exiting
+	ShutdownGrace time.Duration
+
+	// httpClient is shared by all aws clients so the tls settings apply
+	httpClient *http.Client
+}
+
+// defaultConfig returns the settings used for anything the environment
+// leaves unset
+func defaultConfig() *Config {
+	c := &Config{
+		LogOutput:              "stdout",
+		TLSMinVersion:          tls.VersionTLS12,
+		DonePayload:            "full",
+		ErrorSubject:           "firewall.delete.aws.error",
+		ValidationErrorSubject: "firewall.delete.aws.error",
+		DoneSubject:            "firewall.delete.aws.done",
+		DeadLetterSubject:      "firewall.delete.aws.deadletter",
+		ExplainSubject:         "firewall.delete.aws.explain",
+		PlanSubject:            "firewall.delete.aws.plan",
+		ObserveSubject:         "firewall.delete.aws.observed",
+		MaxPayloadBytes:        1024 * 1024,
+		ResultSinks:            []string{"nats", "webhook"},
+		ResultLogMaxBytes:      100 * 1024 * 1024,
+		PendingResultsLimit:    100,
+		RedialAttempts:         3,
+		RedialDelay:            time.Second,
+		HeartbeatInterval:      30 * time.Second,
+		WebhookTimeout:         10 * time.Second,
+		WebhookAttempts:        3,
+		CallTimeout:            30 * time.Second,
+		EventTimeout:           5 * time.Minute,
+		RetryAttempts:          3,
+		RetryBaseDelay:         500 * time.Millisecond,
+		RetryJitter:            "full",
+		PriorityRetryAttempts:  6,
+		DependencyAttempts:     5,
+		DependencyDelay:        2 * time.Second,
+		AssumeRoleAttempts:     5,
+		AssumeRoleDelay:        2 * time.Second,
+		NameConflictPolicy:     "error",
+		VerifyVPC:              true,
+		RevokeChunkSize:        50,
+		Workers:                1,
+		BatchConcurrency:       4,
+		PlanTTL:                15 * time.Minute,
+		ConfirmDeleteInterval:  2 * time.Second,
+		ConfirmDeleteTimeout:   30 * time.Second,
+		ConfirmDeleteAbsences:  1,
+		DescribeCacheSize:      1000,
+		SubjectPrefix:          "firewall",
+		DescribeHandler:        true,
+		ReprocessTTL:           time.Hour,
+		ReprocessSize:          100,
+		ShutdownGrace:          10 * time.Second,
+	}
+	c.httpClient = newHTTPClient(c.TLSMinVersion)
+
+	return c
+}
+
+// envReader parses env values, keeping the first error it finds
+type envReader struct {
+	getenv func(string) string
+	err    error
+}
+
+func (r *envReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// str returns the value of key, or def when unset
+func (r *envReader) str(key, def string) string {
+	if v := r.getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// oneOf returns the value of key, which must be one of the allowed values
+func (r *envReader) oneOf(key, def string, allowed ...string) string {
+	v := r.str(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	r.fail(fmt.Errorf("%s %q is not supported, use one of: %s", key, v, strings.Join(allowed, ", ")))
+	return def
+}
+
+// list returns the comma separated values of key, each of which must
+// be allowed, or def when unset
+func (r *envReader) list(key string, def []string, allowed ...string) []string {
+	v := r.getenv(key)
+	if v == "" {
+		return def
+	}
+
+	var values []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		ok := false
+		for _, a := range allowed {
+			ok = ok || item == a
+		}
+		if !ok {
+			r.fail(fmt.Errorf("%s %q is not supported, use any of: %s", key, item, strings.Join(allowed, ", ")))
+			return def
+		}
+		values = append(values, item)
+	}
+
+	return values
+}
+
+// count returns the non negative integer value of key, or zero when unset
+func (r *envReader) count(key string) int {
+	return r.countOr(key, 0)
+}
+
+// countOr returns the non negative integer value of key, or def when unset
+func (r *envReader) countOr(key string, def int) int {
+	v := r.getenv(key)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		r.fail(fmt.Errorf("%s %q should be a positive number", key, v))
+		return def
+	}
+	return n
+}
+
+// duration returns the non negative duration value of key, or def when unset
+func (r *envReader) duration(key string, def time.Duration) time.Duration {
+	v := r.getenv(key)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		r.fail(fmt.Errorf("%s %q should be a duration e.g. 30s", key, v))
+		return def
+	}
+	return d
+}
+
+// flag returns the boolean value of key, false when unset
+func (r *envReader) flag(key string) bool {
+	return r.flagOr(key, false)
+}
+
+// flagOr returns the boolean value of key, or def when unset
+func (r *envReader) flagOr(key string, def bool) bool {
+	v := r.getenv(key)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		r.fail(fmt.Errorf("%s %q should be true or false", key, v))
+		return def
+	}
+	return b
+}
+
+// loadConfig reads and validates the connector settings
+func loadConfig(getenv func(string) string) (*Config, error) {
+	r := &envReader{getenv: getenv}
+	def := defaultConfig()
+
+	c := &Config{
+		NatsURI:                getenv("NATS_URI"),
+		LogOutput:              r.str("LOG_OUTPUT", def.LogOutput),
+		TLSMinVersion:          def.TLSMinVersion,
+		DonePayload:            r.oneOf("DONE_PAYLOAD", def.DonePayload, "full", "minimal", "empty"),
+		ErrorSubject:           r.str("ERROR_SUBJECT", def.ErrorSubject),
+		ValidationErrorSubject: r.str("VALIDATION_ERROR_SUBJECT", def.ValidationErrorSubject),
+		DoneSubject:            def.DoneSubject,
+		AuditSubject:           r.str("AUDIT_SUBJECT", def.AuditSubject),
+		AuditOmitRules:         r.flag("AUDIT_OMIT_RULES"),
+		HeartbeatSubject:       r.str("HEARTBEAT_SUBJECT", def.HeartbeatSubject),
+		WebhookURL:             r.str("WEBHOOK_URL", def.WebhookURL),
+		MetricsAddr:            r.str("METRICS_ADDR", def.MetricsAddr),
+		StrictListeners:        r.flag("STRICT_LISTENERS"),
+		WebhookSecret:          r.str("WEBHOOK_SECRET", def.WebhookSecret),
+		WebhookTimeout:         r.duration("WEBHOOK_TIMEOUT", def.WebhookTimeout),
+		WebhookAttempts:        def.WebhookAttempts,
+		ResultSinks:            r.list("RESULT_SINKS", def.ResultSinks, "nats", "webhook", "stdout", "file", "mirror"),
+		ResultLogFile:          r.str("RESULT_LOG_FILE", def.ResultLogFile),
+		ResultLogMaxBytes:      r.countOr("RESULT_LOG_MAX_BYTES", def.ResultLogMaxBytes),
+		MirrorNatsURI:          r.str("MIRROR_NATS_URI", def.MirrorNatsURI),
+		HeartbeatInterval:      r.duration("HEARTBEAT_INTERVAL", def.HeartbeatInterval),
+		CallTimeout:            r.duration("AWS_CALL_TIMEOUT", def.CallTimeout),
+		EventTimeout:           r.duration("EVENT_TIMEOUT", def.EventTimeout),
+		IdleTimeout:            r.duration("IDLE_TIMEOUT", def.IdleTimeout),
+		RetryAttempts:          def.RetryAttempts,
+		RetryBaseDelay:         def.RetryBaseDelay,
+		RetryJitter:            r.oneOf("RETRY_JITTER", def.RetryJitter, "full", "equal", "none"),
+		ResultShards:           r.count("RESULT_SHARDS"),
+		MaxAWSClients:          r.count("MAX_AWS_CLIENTS"),
+		MaxEvents:              r.count("MAX_EVENTS"),
+		RevokeChunkSize:        r.countOr("REVOKE_CHUNK_SIZE", def.RevokeChunkSize),
+		Workers:                r.countOr("WORKERS", def.Workers),
+		BatchConcurrency:       r.countOr("BATCH_CONCURRENCY", def.BatchConcurrency),
+		PriorityRetryAttempts:  r.countOr("PRIORITY_RETRY_ATTEMPTS", def.PriorityRetryAttempts),
+		MaxEventAttempts:       r.count("MAX_EVENT_ATTEMPTS"),
+		DependencyAttempts:     r.countOr("DEPENDENCY_RETRY_ATTEMPTS", def.DependencyAttempts),
+		DependencyDelay:        r.duration("DEPENDENCY_RETRY_DELAY", def.DependencyDelay),
+		ProtectionTag:          r.str("PROTECTION_TAG", def.ProtectionTag),
+		AccessKeyFile:          getenv("DATACENTER_ACCESS_KEY_FILE"),
+		AccessTokenFile:        getenv("DATACENTER_ACCESS_TOKEN_FILE"),
+		RegionFile:             getenv("DATACENTER_REGION_FILE"),
+		ObserveOnly:            r.flag("OBSERVE_ONLY"),
+		RequireName:            r.flag("REQUIRE_SECURITY_GROUP_NAME"),
+		RequireRules:           r.flag("REQUIRE_RULES"),
+		DeleteByName:           r.flag("DELETE_BY_NAME"),
+		NameConflictPolicy:     r.oneOf("NAME_CONFLICT_POLICY", def.NameConflictPolicy, "error", "delete_all", "require_vpc"),
+		DefaultVPCID:           r.str("DEFAULT_VPC_ID", def.DefaultVPCID),
+		AggregateRuleErrors:    r.flag("AGGREGATE_RULE_ERRORS"),
+		StrictRulePorts:        r.flag("STRICT_RULE_PORTS"),
+		Diagnostics:            r.flag("DIAGNOSTICS"),
+		AssumeRoleRetry:        r.flag("ASSUME_ROLE_RETRY"),
+		AssumeRoleWithKeys:     r.flag("ASSUME_ROLE_WITH_KEYS"),
+		AssumeRoleAttempts:     def.AssumeRoleAttempts,
+		AssumeRoleDelay:        def.AssumeRoleDelay,
+		RegionOverride:         r.flag("REGION_CREDENTIALS_OVERRIDE"),
+		RevokeBeforeDelete:     r.flag("REVOKE_BEFORE_DELETE"),
+		RevokeStrict:           r.flag("REVOKE_STRICT"),
+		SerializeVPC:           r.flag("SERIALIZE_VPC"),
+		ReconcileBatches:       r.flag("RECONCILE_BATCHES"),
+		ConfirmDelete:          r.flag("CONFIRM_DELETE"),
+		ConfirmDeleteInterval:  r.duration("CONFIRM_DELETE_INTERVAL", def.ConfirmDeleteInterval),
+		ConfirmDeleteTimeout:   r.duration("CONFIRM_DELETE_TIMEOUT", def.ConfirmDeleteTimeout),
+		ConfirmDeleteAbsences:  r.countOr("CONFIRM_DELETE_ABSENCES", def.ConfirmDeleteAbsences),
+		IncludeCallerIdentity:  r.flag("INCLUDE_CALLER_IDENTITY"),
+		CompareRules:           r.flag("COMPARE_RULES"),
+		VerifyVPC:              r.flagOr("VERIFY_VPC", def.VerifyVPC),
+		EC2Endpoint:            r.str("EC2_ENDPOINT", def.EC2Endpoint),
+		EC2SigningRegion:       r.str("EC2_SIGNING_REGION", def.EC2SigningRegion),
+		ResultSpool:            r.str("RESULT_SPOOL", def.ResultSpool),
+		PendingResultsLimit:    def.PendingResultsLimit,
+		ExplicitResultFields:   r.flag("EXPLICIT_RESULT_FIELDS"),
+		DeadLetterSubject:      r.str("DEADLETTER_SUBJECT", def.DeadLetterSubject),
+		ExplainSubject:         r.str("EXPLAIN_SUBJECT", def.ExplainSubject),
+		PlanSubject:            r.str("PLAN_SUBJECT", def.PlanSubject),
+		ObserveSubject:         r.str("OBSERVE_SUBJECT", def.ObserveSubject),
+		MaxPayloadBytes:        r.countOr("MAX_PAYLOAD_BYTES", def.MaxPayloadBytes),
+		SubjectPrefix:          r.str("SUBJECT_PREFIX", def.SubjectPrefix),
+		DescribeHandler:        r.flagOr("DESCRIBE_HANDLER", def.DescribeHandler),
+		ReprocessFailed:        r.flag("REPROCESS_FAILED"),
+		ReprocessTTL:           r.duration("REPROCESS_TTL", def.ReprocessTTL),
+		ReprocessSize:          r.countOr("REPROCESS_SIZE", def.ReprocessSize),
+		ShutdownGrace:          r.duration("SHUTDOWN_GRACE", def.ShutdownGrace),
+		ConfirmBatches:         r.flag("CONFIRM_BATCHES"),
+		PlanTTL:                r.duration("PLAN_TTL", def.PlanTTL),
+		RedialAttempts:         r.countOr("NATS_REDIAL_ATTEMPTS", def.RedialAttempts),
+		RedialDelay:            r.duration("NATS_REDIAL_DELAY", def.RedialDelay),
+		DescribeCacheTTL:       r.duration("DESCRIBE_CACHE_TTL", def.DescribeCacheTTL),
+		DescribeCacheSize:      r.countOr("DESCRIBE_CACHE_SIZE", def.DescribeCacheSize),
+	}
+
+	if err := validateNatsURI(c.NatsURI); err != nil {
+		return nil, err
+	}
+
+	size := r.countOr("SEEN_CACHE_SIZE", 1000)
+	ttl := r.duration("SEEN_TTL", 24*time.Hour)
+
+	store, err := newSeenStore(getenv("SEEN_STORE"), size, ttl)
+	if err != nil {
+		return nil, err
+	}
+	c.Seen = store
+
+	if v := getenv("RESULT_METADATA"); v != "" {
+		if err := json.Unmarshal([]byte(v), &c.ResultMetadata); err != nil {
+			return nil, fmt.Errorf("RESULT_METADATA should be a json object of strings: %s", err.Error())
+		}
+	}
+
+	if err := c.loadRegionCredentials(getenv("REGION_CREDENTIALS"), getenv("REGION_CREDENTIALS_FILE")); err != nil {
+		return nil, err
+	}
+
+	if c.MirrorNatsURI != "" {
+		if err := validateNatsURI(c.MirrorNatsURI); err != nil {
+			return nil, fmt.Errorf("MIRROR_NATS_URI is invalid: %s", err.Error())
+		}
+	}
+
+	if err := c.checkSinks(); err != nil {
+		return nil, err
+	}
+
+	if c.WebhookURL != "" {
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("WEBHOOK_URL %q is malformed, expected an http(s) url", c.WebhookURL)
+		}
+	}
+
+	if v := getenv("TLS_MIN_VERSION"); v != "" {
+		version, err := parseTLSVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		c.TLSMinVersion = version
+	}
+
+	c.httpClient = newHTTPClient(c.TLSMinVersion)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if err := c.checkSubjects(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadRegionCredentials reads the region to credentials map, given as
+// json directly or in a file so it can be mounted as a secret
+func (c *Config) loadRegionCredentials(v, path string) error {
+	key := "REGION_CREDENTIALS"
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("REGION_CREDENTIALS_FILE could not be read: %s", err.Error())
+		}
+		key, v = "REGION_CREDENTIALS_FILE", string(data)
+	}
+
+	if v == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(v), &c.RegionCredentials); err != nil {
+		return fmt.Errorf("%s should be a json object of credentials by region: %s", key, err.Error())
+	}
+
+	for region, rc := range c.RegionCredentials {
+		if (rc.AccessKey == "") != (rc.AccessToken == "") {
+			return fmt.Errorf("%s has incomplete static credentials for %s", key, region)
+		}
+	}
+
+	return nil
+}
+
+// checkSinks adds the file and mirror sinks when they are configured,
+// refusing either sink without its setting
+func (c *Config) checkSinks() error {
+	optional := []struct{ sink, key, value string }{
+		{"file", "RESULT_LOG_FILE", c.ResultLogFile},
+		{"mirror", "MIRROR_NATS_URI", c.MirrorNatsURI},
+	}
+
+	for _, o := range optional {
+		listed := false
+		for _, name := range c.ResultSinks {
+			listed = listed || name == o.sink
+		}
+
+		switch {
+		case listed && o.value == "":
+			return fmt.Errorf("RESULT_SINKS includes %s but %s is not set", o.sink, o.key)
+		case !listed && o.value != "":
+			c.ResultSinks = append(c.ResultSinks, o.sink)
+		}
+	}
+
+	return nil
+}
+
+// checkSubjects refuses subject settings that would make the connector
+// process its own messages: a result published to a subject one of its
+// handlers consumes would be handled again as a new event. Handlers only
+// subscribe on core nats, there is no JetStream mode to register them a
+// second time, but a wildcard prefix would still subscribe them to the
+// subjects of other deployments.
+func (c *Config) checkSubjects() error {
+	for _, token := range strings.Split(c.SubjectPrefix, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t") {
+			return fmt.Errorf("SUBJECT_PREFIX %q should be a literal subject, its handlers would also consume other subjects", c.SubjectPrefix)
+		}
+	}
+
+	handlers := map[string]string{c.SubjectPrefix + ".delete.aws": "delete"}
+	if c.DescribeHandler {
+		handlers[c.SubjectPrefix+".describe.aws"] = "describe"
+	}
+	if c.ReprocessFailed {
+		handlers[c.SubjectPrefix+".delete.aws.retry"] = "retry"
+	}
+
+	published := []struct{ key, subject string }{
+		{"ERROR_SUBJECT", c.ErrorSubject},
+		{"VALIDATION_ERROR_SUBJECT", c.ValidationErrorSubject},
+		{"DEADLETTER_SUBJECT", c.DeadLetterSubject},
+		{"EXPLAIN_SUBJECT", c.ExplainSubject},
+		{"PLAN_SUBJECT", c.PlanSubject},
+		{"OBSERVE_SUBJECT", c.ObserveSubject},
+		{"AUDIT_SUBJECT", c.AuditSubject},
+		{"HEARTBEAT_SUBJECT", c.HeartbeatSubject},
+		{"done subject", c.DoneSubject},
+	}
+
+	for _, p := range published {
+		if handler, ok := handlers[p.subject]; ok {
+			return fmt.Errorf("%s %q is consumed by the %s handler, its messages would be processed again", p.key, p.subject, handler)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testEnv returns a getenv func reading from a map
+func testEnv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestConfig(t *testing.T) {
+	Convey("Given an environment with only a nats uri", t, func() {
+		env := map[string]string{"NATS_URI": "nats://127.0.0.1:4222"}
+
+		Convey("When loading the config", func() {
+			cfg, err := loadConfig(testEnv(env))
+
+			Convey("It should use the defaults", func() {
+				So(err, ShouldBeNil)
+				So(cfg.NatsURI, ShouldEqual, "nats://127.0.0.1:4222")
+				So(cfg.LogOutput, ShouldEqual, "stdout")
+				So(cfg.TLSMinVersion, ShouldEqual, tls.VersionTLS12)
+				So(cfg.DonePayload, ShouldEqual, "full")
+				So(cfg.ErrorSubject, ShouldEqual, "firewall.delete.aws.error")
+				So(cfg.ValidationErrorSubject, ShouldEqual, "firewall.delete.aws.error")
+				So(cfg.RetryJitter, ShouldEqual, "full")
+				So(cfg.ResultShards, ShouldEqual, 0)
+				So(cfg.MaxAWSClients, ShouldEqual, 0)
+				So(cfg.MaxEvents, ShouldEqual, 0)
+				So(cfg.HeartbeatSubject, ShouldEqual, "")
+				So(cfg.HeartbeatInterval, ShouldEqual, 30*time.Second)
+				So(cfg.CallTimeout, ShouldEqual, 30*time.Second)
+				So(cfg.EventTimeout, ShouldEqual, 5*time.Minute)
+				So(cfg.IdleTimeout, ShouldEqual, 0)
+				So(cfg.ObserveOnly, ShouldBeFalse)
+				So(cfg.RequireName, ShouldBeFalse)
+				So(cfg.RequireRules, ShouldBeFalse)
+				So(cfg.ConfirmDelete, ShouldBeFalse)
+				So(cfg.Seen, ShouldBeNil)
+				So(cfg.VerifyVPC, ShouldBeTrue)
+				So(cfg.DeadLetterSubject, ShouldEqual, "firewall.delete.aws.deadletter")
+				So(cfg.ExplainSubject, ShouldEqual, "firewall.delete.aws.explain")
+				So(cfg.PlanSubject, ShouldEqual, "firewall.delete.aws.plan")
+				So(cfg.ObserveSubject, ShouldEqual, "firewall.delete.aws.observed")
+				So(cfg.MaxPayloadBytes, ShouldEqual, 1024*1024)
+				So(cfg.SubjectPrefix, ShouldEqual, "firewall")
+				So(cfg.DescribeHandler, ShouldBeTrue)
+				So(cfg.ShutdownGrace, ShouldEqual, 10*time.Second)
+				So(cfg.ConfirmBatches, ShouldBeFalse)
+				So(cfg.PlanTTL, ShouldEqual, 15*time.Minute)
+				So(cfg.RedialAttempts, ShouldEqual, 3)
+				So(cfg.RedialDelay, ShouldEqual, time.Second)
+				So(cfg.DescribeCacheTTL, ShouldEqual, 0)
+				So(cfg.DescribeCacheSize, ShouldEqual, 1000)
+				So(cfg.DependencyAttempts, ShouldEqual, 5)
+				So(cfg.DependencyDelay, ShouldEqual, 2*time.Second)
+				So(cfg.Workers, ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("Given an environment overriding the defaults", t, func() {
+		env := map[string]string{
+			"NATS_URI":                    "tls://127.0.0.1:4222",
+			"TLS_MIN_VERSION":             "1.3",
+			"DONE_PAYLOAD":                "minimal",
+			"ERROR_SUBJECT":               "test.error",
+			"RETRY_JITTER":                "none",
+			"RESULT_SHARDS":               "4",
+			"MAX_AWS_CLIENTS":             "8",
+			"WORKERS":                     "4",
+			"ASSUME_ROLE_WITH_KEYS":       "true",
+			"HEARTBEAT_SUBJECT":           "firewall.heartbeat",
+			"HEARTBEAT_INTERVAL":          "10s",
+			"AWS_CALL_TIMEOUT":            "5s",
+			"EVENT_TIMEOUT":               "1m",
+			"VERIFY_VPC":                  "false",
+			"RESULT_METADATA":             `{"environment":"prod"}`,
+			"OBSERVE_ONLY":                "true",
+			"CONFIRM_DELETE":              "1",
+			"DATACENTER_REGION_FILE":      "/run/secrets/region",
+			"REQUIRE_SECURITY_GROUP_NAME": "false",
+			"RESULT_SPOOL":                "/var/spool/firewall-deleter/results",
+			"EXPLICIT_RESULT_FIELDS":      "true",
+			"MAX_PAYLOAD_BYTES":           "65536",
+			"SUBJECT_PREFIX":              "staging.firewall",
+			"DESCRIBE_HANDLER":            "false",
+			"RESULT_SINKS":                "nats, stdout",
+			"RESULT_LOG_FILE":             "/var/log/firewall-deleter/results.ndjson",
+		}
+
+		Convey("When loading the config", func() {
+			cfg, err := loadConfig(testEnv(env))
+
+			Convey("It should use the configured values", func() {
+				So(err, ShouldBeNil)
+				So(cfg.TLSMinVersion, ShouldEqual, tls.VersionTLS13)
+				So(cfg.DonePayload, ShouldEqual, "minimal")
+				So(cfg.ErrorSubject, ShouldEqual, "test.error")
+				So(cfg.ValidationErrorSubject, ShouldEqual, "firewall.delete.aws.error")
+				So(cfg.RetryJitter, ShouldEqual, "none")
+				So(cfg.ResultShards, ShouldEqual, 4)
+				So(cfg.MaxAWSClients, ShouldEqual, 8)
+				So(cfg.Workers, ShouldEqual, 4)
+				So(cfg.AssumeRoleWithKeys, ShouldBeTrue)
+				So(cfg.HeartbeatSubject, ShouldEqual, "firewall.heartbeat")
+				So(cfg.HeartbeatInterval, ShouldEqual, 10*time.Second)
+				So(cfg.CallTimeout, ShouldEqual, 5*time.Second)
+				So(cfg.EventTimeout, ShouldEqual, time.Minute)
+				So(cfg.VerifyVPC, ShouldBeFalse)
+				So(cfg.ResultMetadata, ShouldResemble, map[string]string{"environment": "prod"})
+				So(cfg.ObserveOnly, ShouldBeTrue)
+				So(cfg.ConfirmDelete, ShouldBeTrue)
+				So(cfg.RequireName, ShouldBeFalse)
+				So(cfg.RegionFile, ShouldEqual, "/run/secrets/region")
+				So(cfg.ResultSpool, ShouldEqual, "/var/spool/firewall-deleter/results")
+				So(cfg.ExplicitResultFields, ShouldBeTrue)
+				So(cfg.MaxPayloadBytes, ShouldEqual, 65536)
+				So(cfg.SubjectPrefix, ShouldEqual, "staging.firewall")
+				So(cfg.DescribeHandler, ShouldBeFalse)
+				So(cfg.ResultSinks, ShouldResemble, []string{"nats", "stdout", "file"})
+				So(cfg.ResultLogFile, ShouldEqual, "/var/log/firewall-deleter/results.ndjson")
+			})
+		})
+	})
+
+	Convey("Given invalid environment values", t, func() {
+		tests := []struct {
+			key, value, message string
+		}{
+			{"NATS_URI", "", "NATS_URI is not set"},
+			{"NATS_URI", "127.0.0.1:4222", "malformed"},
+			{"TLS_MIN_VERSION", "1.0", "TLS_MIN_VERSION"},
+			{"DONE_PAYLOAD", "partial", "DONE_PAYLOAD"},
+			{"RETRY_JITTER", "some", "RETRY_JITTER"},
+			{"RESULT_SHARDS", "four", "RESULT_SHARDS"},
+			{"MAX_AWS_CLIENTS", "-1", "MAX_AWS_CLIENTS"},
+			{"WORKERS", "-1", "WORKERS"},
+			{"MAX_EVENTS", "ten", "MAX_EVENTS"},
+			{"OBSERVE_ONLY", "maybe", "OBSERVE_ONLY"},
+			{"HEARTBEAT_INTERVAL", "often", "HEARTBEAT_INTERVAL"},
+			{"AWS_CALL_TIMEOUT", "-10s", "AWS_CALL_TIMEOUT"},
+			{"EVENT_TIMEOUT", "never", "EVENT_TIMEOUT"},
+			{"SHUTDOWN_GRACE", "later", "SHUTDOWN_GRACE"},
+			{"NATS_REDIAL_ATTEMPTS", "-1", "NATS_REDIAL_ATTEMPTS"},
+			{"IDLE_TIMEOUT", "soon", "IDLE_TIMEOUT"},
+			{"SEEN_STORE", "etcd://127.0.0.1:2379", "SEEN_STORE"},
+			{"WEBHOOK_URL", "example.com/hook", "WEBHOOK_URL"},
+			{"RESULT_METADATA", `["prod"]`, "RESULT_METADATA"},
+			{"MAX_PAYLOAD_BYTES", "1MB", "MAX_PAYLOAD_BYTES"},
+			{"RESULT_SINKS", "nats,email", "RESULT_SINKS"},
+			{"RESULT_SINKS", "nats,file", "RESULT_LOG_FILE"},
+			{"RESULT_SINKS", "mirror", "MIRROR_NATS_URI"},
+			{"MIRROR_NATS_URI", "127.0.0.1:4223", "MIRROR_NATS_URI"},
+			{"RESULT_LOG_MAX_BYTES", "100MB", "RESULT_LOG_MAX_BYTES"},
+			{"ERROR_SUBJECT", "firewall.delete.aws", "processed again"},
+			{"DEADLETTER_SUBJECT", "firewall.delete.aws", "DEADLETTER_SUBJECT"},
+			{"SUBJECT_PREFIX", "*", "SUBJECT_PREFIX"},
+			{"SUBJECT_PREFIX", "firewall.>", "SUBJECT_PREFIX"},
+			{"SUBJECT_PREFIX", "firewall..staging", "SUBJECT_PREFIX"},
+			{"EXPLAIN_SUBJECT", "firewall.delete.aws", "EXPLAIN_SUBJECT"},
+			{"PLAN_SUBJECT", "firewall.delete.aws", "PLAN_SUBJECT"},
+			{"OBSERVE_SUBJECT", "firewall.delete.aws", "OBSERVE_SUBJECT"},
+			{"AUDIT_SUBJECT", "firewall.describe.aws", "describe handler"},
+			{"REGION_CREDENTIALS", `["eu-west-1"]`, "REGION_CREDENTIALS"},
+			{"REGION_CREDENTIALS", `{"eu-west-1":{"datacenter_secret":"key"}}`, "incomplete"},
+			{"REGION_CREDENTIALS_FILE", "/nonexistent/regions.json", "REGION_CREDENTIALS_FILE"},
+		}
+
+		for _, tt := range tests {
+			env := map[string]string{"NATS_URI": "nats://127.0.0.1:4222"}
+			env[tt.key] = tt.value
+
+			Convey("When "+tt.key+" is "+tt.value, func() {
+				cfg, err := loadConfig(testEnv(env))
+
+				Convey("It should error", func() {
+					So(cfg, ShouldBeNil)
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, tt.message)
+				})
+			})
+		}
+	})
+}
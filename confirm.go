@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrDeleteNotConfirmed = errors.New("Security Group still exists after deletion")
+
+// confirmDeleted polls until the security group is no longer described
+// by ConfirmDeleteAbsences checks in a row, giving up early if the
+// event's context is cancelled
+func (d *deletion) confirmDeleted(id string) error {
+	cfg := d.ev.cfg
+	deadline := time.Now().Add(cfg.ConfirmDeleteTimeout)
+	absences := 0
+
+	for {
+		if err := d.ctx.Err(); err != nil {
+			return fmt.Errorf("confirming deletion of %s aborted: %s", id, err.Error())
+		}
+
+		absent, err := d.groupAbsent(id)
+		if err != nil {
+			return err
+		}
+
+		if !absent {
+			absences = 0
+		} else if absences++; absences >= cfg.ConfirmDeleteAbsences {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return ErrDeleteNotConfirmed
+		}
+
+		select {
+		case <-d.ctx.Done():
+		case <-time.After(cfg.ConfirmDeleteInterval):
+		}
+	}
+}
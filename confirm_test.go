@@ -0,0 +1,210 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfirmDelete(t *testing.T) {
+	Convey("Given delete confirmation is enabled", t, func() {
+		cfg := defaultConfig()
+		cfg.ConfirmDelete = true
+		cfg.VerifyVPC = false
+		cfg.ConfirmDeleteInterval = time.Millisecond
+		cfg.ConfirmDeleteTimeout = 20 * time.Millisecond
+
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When the group keeps being described after deletion", func() {
+			fake.groups = []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000")}}
+			_, err := deleteFirewall(&ev)
+			Convey("It should error once the confirmation times out", func() {
+				So(err, ShouldEqual, ErrDeleteNotConfirmed)
+				So(fake.describeCalls, ShouldBeGreaterThan, 1)
+			})
+		})
+
+		Convey("When the group is reported as not found", func() {
+			fake.describeErr = awserr.New("InvalidGroup.NotFound", "not found", nil)
+			_, err := deleteFirewall(&ev)
+			Convey("It should confirm the deletion", func() {
+				So(err, ShouldBeNil)
+				So(fake.describeCalls, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When describing fails", func() {
+			fake.describeErr = awserr.New("UnauthorizedOperation", "denied", nil)
+			_, err := deleteFirewall(&ev)
+			Convey("It should return the error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "UnauthorizedOperation")
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+// flappingEC2 describes a group as missing or present in turn, as an
+// eventually consistent api can after a deletion
+type flappingEC2 struct {
+	*fakeEC2
+	absent []bool
+}
+
+func (f *flappingEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, in *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.describeCalls++
+
+	absent := true
+	if len(f.absent) > 0 {
+		absent, f.absent = f.absent[0], f.absent[1:]
+	}
+	if absent {
+		return nil, awserr.New("InvalidGroup.NotFound", "not found", nil)
+	}
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000")}}}, nil
+}
+
+func TestConfirmAbsences(t *testing.T) {
+	Convey("Given a describe that flaps after the deletion", t, func() {
+		cfg := defaultConfig()
+		cfg.ConfirmDelete = true
+		cfg.VerifyVPC = false
+		cfg.ConfirmDeleteInterval = time.Millisecond
+		cfg.ConfirmDeleteTimeout = time.Second
+
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &flappingEC2{fakeEC2: &fakeEC2{}, absent: []bool{true, false, true, true}}
+		restore := useFakeEC2(fake)
+
+		Convey("When a single not found confirms the deletion", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should complete on the first not found", func() {
+				So(err, ShouldBeNil)
+				So(fake.describeCalls, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When two consecutive not founds are required", func() {
+			cfg.ConfirmDeleteAbsences = 2
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should wait for two not founds in a row", func() {
+				So(err, ShouldBeNil)
+				So(fake.describeCalls, ShouldEqual, 4)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the group keeps reappearing", func() {
+			cfg.ConfirmDeleteAbsences = 2
+			cfg.ConfirmDeleteTimeout = 20 * time.Millisecond
+			fake.absent = []bool{true, false, true, false, true, false}
+			for i := 0; i < 100; i++ {
+				fake.absent = append(fake.absent, false)
+			}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not confirm the deletion", func() {
+				So(err, ShouldEqual, ErrDeleteNotConfirmed)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+func TestDeletingGroups(t *testing.T) {
+	Convey("Given a group another request is still deleting", t, func() {
+		cfg := defaultConfig()
+		cfg.VerifyVPC = false
+		cfg.ConfirmDeleteInterval = time.Millisecond
+		cfg.ConfirmDeleteTimeout = 20 * time.Millisecond
+
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &flappingEC2{fakeEC2: &fakeEC2{deleteErr: awserr.New("IncorrectState", "The security group is being deleted", nil)}}
+		restore := useFakeEC2(fake)
+
+		Convey("When it disappears shortly after", func() {
+			fake.absent = []bool{false, false, true}
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should wait for it and report it already deleted", func() {
+				So(err, ShouldBeNil)
+				So(fake.describeCalls, ShouldEqual, 3)
+				So(res.AlreadyDeleted, ShouldResemble, []string{"sg-0000000"})
+				So(res.DeletedIDs, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When it never disappears", func() {
+			for i := 0; i < 100; i++ {
+				fake.absent = append(fake.absent, false)
+			}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should error once the wait times out", func() {
+				So(err, ShouldEqual, ErrDeleteNotConfirmed)
+			})
+		})
+
+		Reset(restore)
+	})
+}
+
+func TestConfirmCancellation(t *testing.T) {
+	Convey("Given a group that keeps being described", t, func() {
+		cfg := defaultConfig()
+		cfg.ConfirmDeleteInterval = 10 * time.Millisecond
+		cfg.ConfirmDeleteTimeout = time.Minute
+
+		ctx, cancel := context.WithCancel(context.Background())
+		fake := &fakeEC2{groups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000")}}}
+		d := &deletion{ctx: ctx, ev: &testEvent, svc: fake, result: &DeleteResult{}}
+
+		Convey("When the event is cancelled mid-poll", func() {
+			time.AfterFunc(25*time.Millisecond, cancel)
+			start := time.Now()
+			err := d.confirmDeleted("sg-0000000")
+
+			Convey("It should abort promptly with a context error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "context canceled")
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Convey("When the event is already cancelled", func() {
+			cancel()
+			_, err := d.describeGroup("sg-0000000")
+
+			Convey("It should not describe the group", func() {
+				So(err, ShouldEqual, context.Canceled)
+				So(fake.describeCalls, ShouldEqual, 0)
+			})
+		})
+
+		Reset(cancel)
+	})
+}
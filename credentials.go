@@ -0,0 +1,202 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// regionCredentials are configured credentials for a region, with the
+// same fields and precedence as an event's
+type regionCredentials struct {
+	AccessKey     string `json:"datacenter_secret"`
+	AccessToken   string `json:"datacenter_token"`
+	SessionToken  string `json:"datacenter_access_session_token"`
+	AssumeRoleARN string `json:"datacenter_assume_role_arn"`
+	ExternalID    string `json:"datacenter_external_id"`
+	Profile       string `json:"datacenter_profile"`
+}
+
+// newAssumeRoler builds the sts client used to assume datacenter roles
+var newAssumeRoler = func(cfg *aws.Config) stscreds.AssumeRoler {
+	return sts.New(session.New(), cfg)
+}
+
+// credential sources, in order of precedence
+const (
+	sourceStatic  = "static"
+	sourceRole    = "role"
+	sourceProfile = "profile"
+	sourceDefault = "default"
+)
+
+// credentialSource picks where an event's credentials come from when
+// it carries more than one: static keys, then a role, then a shared
+// config profile, falling back to the default chain. With
+// AssumeRoleWithKeys a role comes first, assumed with the keys.
+func credentialSource(ev *Event) string {
+	static := ev.DatacenterAccessKey != "" && ev.DatacenterAccessToken != ""
+	switch {
+	case ev.DatacenterAssumeRoleARN != "" && (!static || ev.cfg.AssumeRoleWithKeys):
+		return sourceRole
+	case static:
+		return sourceStatic
+	case ev.DatacenterProfile != "":
+		return sourceProfile
+	}
+	return sourceDefault
+}
+
+// credentialEvent returns the event with the credentials configured for
+// its region in place of its own, or the event itself when none apply
+func credentialEvent(ev *Event) *Event {
+	rc, ok := ev.cfg.RegionCredentials[ev.DatacenterRegion]
+	if !ok || (!ev.cfg.RegionOverride && credentialSource(ev) != sourceDefault) {
+		return ev
+	}
+
+	src := *ev
+	src.DatacenterAccessKey = rc.AccessKey
+	src.DatacenterAccessToken = rc.AccessToken
+	src.DatacenterSessionToken = rc.SessionToken
+	src.DatacenterAssumeRoleARN = rc.AssumeRoleARN
+	src.DatacenterExternalID = rc.ExternalID
+	src.DatacenterProfile = rc.Profile
+	return &src
+}
+
+// credentialsFor builds the credentials for an event's datacenter from
+// the source credentialSource picks
+func credentialsFor(ev *Event) *credentials.Credentials {
+	if ev.creds != nil {
+		return ev.creds
+	}
+
+	src := credentialEvent(ev)
+	if src != ev {
+		log.Printf("using the credentials configured for region %s for event %s", ev.DatacenterRegion, ev.UUID)
+	}
+	log.Printf("using %s for event %s", describeCredentials(src), ev.UUID)
+
+	switch credentialSource(src) {
+	case sourceRole:
+		ev.creds = roleCredentials(src)
+	case sourceStatic:
+		ev.creds = credentials.NewStaticCredentials(src.DatacenterAccessKey, src.DatacenterAccessToken, src.DatacenterSessionToken)
+	case sourceProfile:
+		ev.creds = credentials.NewSharedCredentials("", src.DatacenterProfile)
+	default:
+		ev.creds = defaultCredentials()
+	}
+
+	return ev.creds
+}
+
+// describeCredentials says which credentials an event with the given
+// source resolves to, hiding any secret
+func describeCredentials(src *Event) string {
+	switch credentialSource(src) {
+	case sourceRole:
+		return "role " + src.DatacenterAssumeRoleARN
+	case sourceStatic:
+		return "static credentials " + redact(src.DatacenterAccessKey)
+	case sourceProfile:
+		return "profile " + src.DatacenterProfile
+	}
+	return "the default credential chain"
+}
+
+// credentialKey identifies the credentials an event resolves to, its
+// own or its region's, so results looked up with them can be cached
+func credentialKey(ev *Event) string {
+	src := credentialEvent(ev)
+
+	switch source := credentialSource(src); source {
+	case sourceRole:
+		return source + "|" + src.DatacenterAssumeRoleARN + "|" + src.DatacenterExternalID
+	case sourceStatic:
+		return source + "|" + src.DatacenterAccessKey
+	case sourceProfile:
+		return source + "|" + src.DatacenterProfile
+	}
+	return sourceDefault
+}
+
+// roleCredentials assumes the event's role, signing the assume-role
+// call with the event's static keys, its profile or the default chain
+func roleCredentials(ev *Event) *credentials.Credentials {
+	var creds *credentials.Credentials
+	switch {
+	case ev.DatacenterAccessKey != "" && ev.DatacenterAccessToken != "":
+		creds = credentials.NewStaticCredentials(ev.DatacenterAccessKey, ev.DatacenterAccessToken, ev.DatacenterSessionToken)
+	case ev.DatacenterProfile != "":
+		creds = credentials.NewSharedCredentials("", ev.DatacenterProfile)
+	default:
+		creds = defaultCredentials()
+	}
+
+	base := &aws.Config{
+		Region:           aws.String(ev.DatacenterRegion),
+		Credentials:      creds,
+		HTTPClient:       ev.cfg.httpClient,
+		EndpointResolver: resolverFor(ev),
+	}
+
+	return stscreds.NewCredentialsWithClient(newAssumeRoler(base), ev.DatacenterAssumeRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if ev.DatacenterExternalID != "" {
+			p.ExternalID = aws.String(ev.DatacenterExternalID)
+		}
+	})
+}
+
+// defaultCredentials reads credentials from the environment, shared
+// config or instance profile
+func defaultCredentials() *credentials.Credentials {
+	return defaults.CredChain(defaults.Config(), defaults.Handlers())
+}
+
+// redact hides all but the start of an access key for logging
+func redact(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
+
+// assumeRole fetches the role credentials before they are used, giving
+// up on retries once ctx is done
+func assumeRole(ctx context.Context, ev *Event) error {
+	if credentialSource(credentialEvent(ev)) != sourceRole {
+		return nil
+	}
+
+	attempts := 1
+	if ev.cfg.AssumeRoleRetry {
+		attempts = ev.cfg.AssumeRoleAttempts
+	}
+
+	creds := credentialsFor(ev)
+	delay := ev.cfg.AssumeRoleDelay
+
+	for attempt := 1; ; attempt++ {
+		_, err := creds.Get()
+		if err == nil || errorCode(err) != "AccessDenied" || attempt >= attempts {
+			return err
+		}
+
+		if err := pause(ctx, delay); err != nil {
+			return err
+		}
+		delay = delay * 2
+	}
+}
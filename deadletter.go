@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+var ErrPayloadTooLarge = errors.New("Event payload is too large")
+
+// deadLetter describes a rejected message
+type deadLetter struct {
+	Status        string `json:"status"`
+	Subject       string `json:"subject"`
+	Size          int    `json:"size"`
+	Limit         int    `json:"limit,omitempty"`
+	Reason        string `json:"error"`
+	ErrorCode     string `json:"error_code,omitempty"`
+	ErrorCategory string `json:"error_category,omitempty"`
+}
+
+// oversized checks if a message exceeds MaxPayloadBytes
+func oversized(cfg *Config, data []byte) bool {
+	return cfg.MaxPayloadBytes > 0 && len(data) > cfg.MaxPayloadBytes
+}
+
+// rejectOversized sends a summary of an oversized message to the
+// dead letter subject and the requester, leaving the payload unread
+func rejectOversized(cfg *Config, subject, reply string, data []byte) {
+	log.Printf("Error: %s, %d bytes received on %s, the limit is %d", ErrPayloadTooLarge.Error(), len(data), subject, cfg.MaxPayloadBytes)
+
+	sendDeadLetter(cfg, reply, deadLetter{
+		Subject: subject,
+		Size:    len(data),
+		Limit:   cfg.MaxPayloadBytes,
+		Reason:  ErrPayloadTooLarge.Error(),
+	})
+}
+
+// malformed checks if a payload failed to parse because it is not json
+// at all, as when a message is truncated, rather than for holding the
+// wrong types
+func malformed(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(*json.SyntaxError)
+	return ok
+}
+
+// rejectMalformed sends a summary of a message that is not json to the
+// dead letter subject and the requester
+func rejectMalformed(cfg *Config, subject, reply string, data []byte, err error) {
+	log.Printf("Error: malformed event of %d bytes received on %s: %s", len(data), subject, err.Error())
+
+	sendDeadLetter(cfg, reply, deadLetter{
+		Subject:       subject,
+		Size:          len(data),
+		Reason:        err.Error(),
+		ErrorCode:     "malformed",
+		ErrorCategory: categoryTransport,
+	})
+}
+
+// sendDeadLetter publishes a rejected message's summary
+func sendDeadLetter(cfg *Config, reply string, letter deadLetter) {
+	letter.Status = statusFailed
+	msg, err := json.Marshal(letter)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	publish(cfg, cfg.DeadLetterSubject, msg)
+	if reply != "" {
+		publishReply(cfg, reply, msg)
+	}
+}
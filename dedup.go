@@ -0,0 +1,251 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeenStore remembers the uuids of processed events so redelivered
+// events are not processed twice
+type SeenStore interface {
+	Seen(uuid string) bool
+	Mark(uuid string)
+}
+
+// newSeenStore builds the store described by SEEN_STORE: empty disables
+// dedup, memory keeps up to size ids in process and a redis:// url
+// shares them across replicas and restarts for ttl
+func newSeenStore(uri string, size int, ttl time.Duration) (SeenStore, error) {
+	switch {
+	case uri == "":
+		return nil, nil
+	case uri == "memory":
+		return newMemoryStore(size), nil
+	case strings.HasPrefix(uri, "redis://"):
+		return newRedisStore(uri, ttl)
+	}
+
+	return nil, fmt.Errorf("SEEN_STORE %q is not supported, use memory or a redis:// url", uri)
+}
+
+// newRedisStore builds a store from a redis://[user:password@]host:port[/db]
+// url, authenticating and selecting the database on every connection
+func newRedisStore(uri string, ttl time.Duration) (*redisStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("SEEN_STORE %q is malformed, expected a redis://host:port url", uri)
+	}
+
+	s := &redisStore{addr: u.Host, ttl: ttl}
+
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			s.user, s.password = u.User.Username(), password
+		} else {
+			s.password = u.User.Username()
+		}
+	}
+
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("SEEN_STORE names an invalid redis database %q, expected a number", db)
+		}
+		s.db = n
+	}
+
+	return s, nil
+}
+
+// memoryStore keeps the most recently marked uuids in process
+type memoryStore struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newMemoryStore(size int) *memoryStore {
+	return &memoryStore{
+		size:  size,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
+}
+
+// Seen checks if a uuid was marked
+func (s *memoryStore) Seen(uuid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.ids[uuid]
+	return ok
+}
+
+// Mark remembers a uuid, forgetting the oldest one when full
+func (s *memoryStore) Mark(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.ids[uuid]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.ids[uuid] = s.order.PushFront(uuid)
+
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+}
+
+// redisStore keeps marked uuids in redis, expiring them after ttl
+type redisStore struct {
+	mu       sync.Mutex
+	addr     string
+	user     string
+	password string
+	db       int
+	ttl      time.Duration
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+func (s *redisStore) key(uuid string) string {
+	return "firewall-deleter-aws:seen:" + uuid
+}
+
+// Seen checks if a uuid was marked, treating redis errors as unseen so
+// an outage doesn't stop events being processed
+func (s *redisStore) Seen(uuid string) bool {
+	reply, err := s.do("EXISTS", s.key(uuid))
+	if err != nil {
+		log.Printf("Warning: could not check seen events: %s", err.Error())
+		return false
+	}
+	return reply == "1"
+}
+
+// Mark remembers a uuid
+func (s *redisStore) Mark(uuid string) {
+	ttl := fmt.Sprintf("%d", int64(s.ttl/time.Second))
+	if _, err := s.do("SET", s.key(uuid), "1", "EX", ttl); err != nil {
+		log.Printf("Warning: could not mark event %s as seen: %s", uuid, err.Error())
+	}
+}
+
+// do sends a command and reads a simple, integer or error reply,
+// reconnecting if the previous connection failed
+func (s *redisStore) do(args ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+		if err != nil {
+			return "", err
+		}
+		s.conn = conn
+		s.r = bufio.NewReader(conn)
+
+		if err := s.setup(); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return "", err
+		}
+	}
+
+	reply, err := s.roundTrip(args)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return reply, err
+}
+
+// setup authenticates a new connection and selects the url's database
+func (s *redisStore) setup() error {
+	if s.password != "" {
+		auth := []string{"AUTH", s.password}
+		if s.user != "" {
+			auth = []string{"AUTH", s.user, s.password}
+		}
+		if _, err := s.roundTrip(auth); err != nil {
+			return err
+		}
+	}
+
+	if s.db != 0 {
+		if _, err := s.roundTrip([]string{"SELECT", strconv.Itoa(s.db)}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *redisStore) roundTrip(args []string) (string, error) {
+	s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+
+	if _, err := s.conn.Write([]byte(cmd)); err != nil {
+		return "", err
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	if line == "" {
+		return "", fmt.Errorf("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("redis: %s", line[1:])
+	}
+
+	return "", fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// skipDuplicate answers a duplicate event sent as a request with a
+// skipped result, so the requester isn't left waiting for a reply. The
+// result is not published again, the first delivery already was.
+func (ev *Event) skipDuplicate() {
+	if ev.reply == "" {
+		return
+	}
+
+	ev.Status = statusSkipped
+	ev.enrich()
+
+	data, err := ev.donePayload()
+	if err != nil {
+		log.Printf("Warning: could not answer duplicate event %s: %s", ev.UUID, err.Error())
+		return
+	}
+	ev.respond(data)
+}
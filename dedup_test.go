@@ -0,0 +1,275 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeStore records the calls made to a SeenStore
+type fakeStore struct {
+	marked []string
+	known  map[string]bool
+}
+
+func (s *fakeStore) Seen(uuid string) bool {
+	return s.known[uuid]
+}
+
+func (s *fakeStore) Mark(uuid string) {
+	s.marked = append(s.marked, uuid)
+}
+
+// fakeRedis answers the commands of a redisStore, recording them
+type fakeRedis struct {
+	mu       sync.Mutex
+	l        net.Listener
+	commands []string
+}
+
+func newFakeRedis() *fakeRedis {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	f := &fakeRedis{l: l}
+	go f.serve()
+	return f
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || len(line) < 2 {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+		var args []string
+		for i := 0; i < n; i++ {
+			r.ReadString('\n')
+			arg, _ := r.ReadString('\n')
+			args = append(args, strings.TrimSpace(arg))
+		}
+
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		f.mu.Unlock()
+
+		if args[0] == "EXISTS" {
+			conn.Write([]byte(":0\r\n"))
+		} else {
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}
+}
+
+func (f *fakeRedis) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func TestMemoryStore(t *testing.T) {
+	Convey("Given an in-memory store", t, func() {
+		s := newMemoryStore(2)
+
+		Convey("When uuids are marked", func() {
+			s.Mark("a")
+			s.Mark("b")
+
+			Convey("It should report them as seen", func() {
+				So(s.Seen("a"), ShouldBeTrue)
+				So(s.Seen("b"), ShouldBeTrue)
+				So(s.Seen("c"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When more uuids are marked than it holds", func() {
+			s.Mark("a")
+			s.Mark("b")
+			s.Mark("a")
+			s.Mark("c")
+
+			Convey("It should forget the least recently marked", func() {
+				So(s.Seen("a"), ShouldBeTrue)
+				So(s.Seen("b"), ShouldBeFalse)
+				So(s.Seen("c"), ShouldBeTrue)
+			})
+		})
+	})
+
+	Convey("Given a store configuration", t, func() {
+		Convey("It should build the configured store", func() {
+			s, err := newSeenStore("", 10, time.Hour)
+			So(err, ShouldBeNil)
+			So(s, ShouldBeNil)
+
+			s, err = newSeenStore("memory", 10, time.Hour)
+			So(err, ShouldBeNil)
+			So(s, ShouldHaveSameTypeAs, &memoryStore{})
+
+			s, err = newSeenStore("redis://127.0.0.1:6379", 10, time.Hour)
+			So(err, ShouldBeNil)
+			So(s, ShouldHaveSameTypeAs, &redisStore{})
+
+			_, err = newSeenStore("etcd://127.0.0.1:2379", 10, time.Hour)
+			So(err, ShouldNotBeNil)
+
+			_, err = newSeenStore("redis://127.0.0.1:6379/cache", 10, time.Hour)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestRedisStore(t *testing.T) {
+	Convey("Given a redis store", t, func() {
+		log.SetOutput(ioutil.Discard)
+		server := newFakeRedis()
+
+		Convey("When its url carries a user, password and database", func() {
+			s, err := newSeenStore("redis://ernest:secret@"+server.l.Addr().String()+"/2", 10, time.Hour)
+			So(err, ShouldBeNil)
+			s.Seen("a")
+			s.Mark("a")
+
+			Convey("It should authenticate and select the database once connected", func() {
+				So(server.received(), ShouldResemble, []string{
+					"AUTH ernest secret",
+					"SELECT 2",
+					"EXISTS firewall-deleter-aws:seen:a",
+					"SET firewall-deleter-aws:seen:a 1 EX 3600",
+				})
+			})
+		})
+
+		Convey("When its url only carries a password", func() {
+			s, err := newSeenStore("redis://:secret@"+server.l.Addr().String(), 10, time.Hour)
+			So(err, ShouldBeNil)
+			s.Seen("a")
+
+			Convey("It should authenticate without a user", func() {
+				So(server.received(), ShouldResemble, []string{
+					"AUTH secret",
+					"EXISTS firewall-deleter-aws:seen:a",
+				})
+			})
+		})
+
+		Convey("When its url carries neither", func() {
+			s, err := newSeenStore("redis://"+server.l.Addr().String(), 10, time.Hour)
+			So(err, ShouldBeNil)
+			s.Seen("a")
+
+			Convey("It should send the command alone", func() {
+				So(server.received(), ShouldResemble, []string{
+					"EXISTS firewall-deleter-aws:seen:a",
+				})
+			})
+		})
+
+		Reset(func() {
+			server.l.Close()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestDedup(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given a seen store", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+		data, _ := json.Marshal(testEvent)
+
+		Convey("When an event is delivered twice with the in-memory store", func() {
+			cfg.Seen = newMemoryStore(10)
+			eventHandler(cfg, &nats.Msg{Data: data})
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should only process it once", func() {
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+				_, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				msg, _ := waitMsg(completed)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When the store already knows the event", func() {
+			store := &fakeStore{known: map[string]bool{"test": true}}
+			cfg.Seen = store
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should skip it", func() {
+				So(fake.deleted, ShouldBeEmpty)
+				So(store.marked, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the store already knows an event sent as a request", func() {
+			cfg.Seen = &fakeStore{known: map[string]bool{"test": true}}
+			replies := make(chan *nats.Msg, 10)
+			sub, _ := conn().ChanSubscribe("test.reply.duplicate", replies)
+			defer sub.Unsubscribe()
+			eventHandler(cfg, &nats.Msg{Data: data, Reply: "test.reply.duplicate"})
+
+			Convey("It should answer with a skipped result without publishing it", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				var res Event
+				So(json.Unmarshal(msg.Data, &res), ShouldBeNil)
+				So(res.Status, ShouldEqual, statusSkipped)
+				So(fake.deleted, ShouldBeEmpty)
+				msg, _ = waitMsg(completed)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When the store doesn't know the event", func() {
+			store := &fakeStore{}
+			cfg.Seen = store
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should process and mark it", func() {
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+				So(store.marked, ShouldResemble, []string{"test"})
+			})
+		})
+
+		Reset(func() {
+			cfg.Seen = nil
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+)
+
+var ErrSGNotFound = errors.New("Security Group not found")
+
+// deleteSubject is the subject delete events arrive on
+func deleteSubject(cfg *Config) string {
+	return cfg.SubjectPrefix + ".delete.aws"
+}
+
+// describeSubject is the subject describe requests arrive on
+func describeSubject(cfg *Config) string {
+	return cfg.SubjectPrefix + ".describe.aws"
+}
+
+// description is the reply to a describe request
+type description struct {
+	SecurityGroup *ec2.SecurityGroup `json:"security_group,omitempty"`
+	Dependencies  *dependencies      `json:"dependencies,omitempty"`
+	ErrorMessage  string             `json:"error,omitempty"`
+}
+
+// subscribeDescribe registers the describe handler unless it is disabled
+func subscribeDescribe(cfg *Config, c *nats.Conn) (*nats.Subscription, error) {
+	if !cfg.DescribeHandler {
+		return nil, nil
+	}
+
+	log.Printf("listening for %s", describeSubject(cfg))
+	return c.Subscribe(describeSubject(cfg), func(m *nats.Msg) {
+		describeHandler(cfg, m)
+	})
+}
+
+// describeHandler replies with the security group an event targets,
+// and what still references it when diagnostics are enabled
+func describeHandler(cfg *Config, m *nats.Msg) {
+	defer exitOnPanic()
+
+	if m.Reply == "" {
+		return
+	}
+
+	res := describe(cfg, m.Data)
+	if res.ErrorMessage != "" {
+		log.Printf("Error: %s", res.ErrorMessage)
+	}
+
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.Panic(err)
+	}
+	publishReply(cfg, m.Reply, data)
+}
+
+// describe looks up the security group of a raw event
+func describe(cfg *Config, data []byte) *description {
+	ev := Event{cfg: cfg}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return &description{ErrorMessage: err.Error()}
+	}
+
+	if err := applySecretFiles(&ev); err != nil {
+		return &description{ErrorMessage: err.Error()}
+	}
+	ev.applyDefaults()
+
+	if err := ev.Validate(); err != nil {
+		return &description{ErrorMessage: err.Error()}
+	}
+
+	if ev.SecurityGroupAWSID == "" {
+		return &description{ErrorMessage: ErrSGAWSIDInvalid.Error()}
+	}
+
+	release := acquireClient(ev.highPriority())
+	defer release()
+
+	ctx, cancel := eventContext(cfg)
+	defer cancel()
+
+	if err := assumeRole(ctx, &ev); err != nil {
+		return &description{ErrorMessage: err.Error()}
+	}
+
+	d := &deletion{ctx: ctx, ev: &ev, svc: newEC2Client(&ev), result: &DeleteResult{}}
+
+	sg, err := d.describeGroup(ev.SecurityGroupAWSID)
+	if err != nil {
+		return &description{ErrorMessage: err.Error()}
+	}
+	if sg == nil {
+		return &description{ErrorMessage: ErrSGNotFound.Error()}
+	}
+
+	res := &description{SecurityGroup: sg}
+	if cfg.Diagnostics {
+		res.Dependencies = d.dependenciesOf(ev.SecurityGroupAWSID)
+	}
+
+	return res
+}
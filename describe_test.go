@@ -0,0 +1,78 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDescribeHandler(t *testing.T) {
+	testSetup()
+
+	Convey("Given a subject prefix", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.SubjectPrefix = "test.firewall"
+		fake := &fakeEC2{groups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}}}
+		restore := useFakeEC2(fake)
+		data, _ := json.Marshal(testEvent)
+
+		Convey("When the describe handler is enabled", func() {
+			sub, err := subscribeDescribe(cfg, conn())
+			So(err, ShouldBeNil)
+			msg, rerr := conn().Request("test.firewall.describe.aws", data, time.Second)
+
+			Convey("It should reply with the security group on the prefixed subject", func() {
+				So(sub == nil, ShouldBeFalse)
+				So(rerr, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"GroupId":"sg-0000000"`)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+
+			Reset(func() {
+				if sub != nil {
+					sub.Unsubscribe()
+				}
+			})
+		})
+
+		Convey("When the describe handler is disabled", func() {
+			cfg.DescribeHandler = false
+			sub, err := subscribeDescribe(cfg, conn())
+			_, rerr := conn().Request("test.firewall.describe.aws", data, 100*time.Millisecond)
+
+			Convey("It should not be registered", func() {
+				So(err, ShouldBeNil)
+				So(sub == nil, ShouldBeTrue)
+				So(rerr, ShouldNotBeNil)
+				So(fake.describeCalls, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the group does not exist", func() {
+			fake.groups = nil
+			res := describe(cfg, data)
+
+			Convey("It should reply with an error", func() {
+				So(res.ErrorMessage, ShouldEqual, ErrSGNotFound.Error())
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+// dependencies lists the resources still referencing a security group
+type dependencies struct {
+	NetworkInterfaces []string `json:"network_interfaces,omitempty"`
+	Instances         []string `json:"instances,omitempty"`
+	LoadBalancers     []string `json:"load_balancers,omitempty"`
+}
+
+// elbClient is the subset of the classic ELB api used by the connector
+type elbClient interface {
+	DescribeLoadBalancersWithContext(aws.Context, *elb.DescribeLoadBalancersInput, ...request.Option) (*elb.DescribeLoadBalancersOutput, error)
+}
+
+// elbv2Client is the subset of the ELBv2 api used by the connector
+type elbv2Client interface {
+	DescribeLoadBalancersWithContext(aws.Context, *elbv2.DescribeLoadBalancersInput, ...request.Option) (*elbv2.DescribeLoadBalancersOutput, error)
+}
+
+var newELBClient = func(ev *Event) elbClient {
+	return elb.New(session.New(), awsConfig(ev))
+}
+
+var newELBV2Client = func(ev *Event) elbv2Client {
+	return elbv2.New(session.New(), awsConfig(ev))
+}
+
+// diagnose records the resources that prevented a group from being deleted
+func (d *deletion) diagnose(id string, err error) {
+	if !d.ev.cfg.Diagnostics || !isDependencyViolation(err) {
+		return
+	}
+
+	d.ev.Dependencies = d.dependenciesOf(id)
+}
+
+// dependenciesOf gathers every resource found referencing a group, nil
+// when there are none. Lookups that fail are logged and skipped so the
+// others are still reported.
+func (d *deletion) dependenciesOf(id string) *dependencies {
+	var deps dependencies
+	var err error
+
+	deps.NetworkInterfaces, deps.Instances, err = d.interfacesUsing(id)
+	if err != nil {
+		log.Printf("Warning: could not look up network interfaces using %s: %s", id, err.Error())
+	}
+
+	deps.LoadBalancers, err = d.loadBalancersUsing(id)
+	if err != nil {
+		log.Printf("Warning: could not look up load balancers using %s: %s", id, err.Error())
+	}
+
+	if len(deps.NetworkInterfaces) == 0 && len(deps.Instances) == 0 && len(deps.LoadBalancers) == 0 {
+		return nil
+	}
+
+	return &deps
+}
+
+// interfacesUsing finds the network interfaces referencing a group, and
+// the instances they are attached to
+func (d *deletion) interfacesUsing(id string) ([]string, []string, error) {
+	var enis, instances []string
+
+	req := ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("group-id"), Values: []*string{aws.String(id)}},
+		},
+	}
+	for {
+		var resp *ec2.DescribeNetworkInterfacesOutput
+		err := d.call("DescribeNetworkInterfaces", func(ctx aws.Context) (err error) {
+			resp, err = d.svc.DescribeNetworkInterfacesWithContext(ctx, &req)
+			return err
+		})
+		if err != nil {
+			return enis, instances, err
+		}
+		if resp == nil {
+			return enis, instances, ErrEmptyResponse
+		}
+
+		for _, eni := range resp.NetworkInterfaces {
+			if eni == nil {
+				continue
+			}
+			enis = append(enis, aws.StringValue(eni.NetworkInterfaceId))
+			if eni.Attachment != nil && aws.StringValue(eni.Attachment.InstanceId) != "" {
+				instances = append(instances, aws.StringValue(eni.Attachment.InstanceId))
+			}
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		req.NextToken = resp.NextToken
+	}
+
+	return enis, instances, nil
+}
+
+// loadBalancersUsing finds classic and v2 load balancers referencing a group
+func (d *deletion) loadBalancersUsing(id string) ([]string, error) {
+	var lbs []string
+
+	classic := newELBClient(d.ev)
+	req := elb.DescribeLoadBalancersInput{}
+	for {
+		var resp *elb.DescribeLoadBalancersOutput
+		err := d.call("DescribeLoadBalancers", func(ctx aws.Context) (err error) {
+			resp, err = classic.DescribeLoadBalancersWithContext(ctx, &req)
+			return err
+		})
+		if err != nil {
+			return lbs, err
+		}
+		if resp == nil {
+			return lbs, ErrEmptyResponse
+		}
+
+		for _, lb := range resp.LoadBalancerDescriptions {
+			if lb != nil && containsID(lb.SecurityGroups, id) {
+				lbs = append(lbs, aws.StringValue(lb.LoadBalancerName))
+			}
+		}
+
+		if aws.StringValue(resp.NextMarker) == "" {
+			break
+		}
+		req.Marker = resp.NextMarker
+	}
+
+	v2 := newELBV2Client(d.ev)
+	reqv2 := elbv2.DescribeLoadBalancersInput{}
+	for {
+		var resp *elbv2.DescribeLoadBalancersOutput
+		err := d.call("DescribeLoadBalancersV2", func(ctx aws.Context) (err error) {
+			resp, err = v2.DescribeLoadBalancersWithContext(ctx, &reqv2)
+			return err
+		})
+		if err != nil {
+			return lbs, err
+		}
+		if resp == nil {
+			return lbs, ErrEmptyResponse
+		}
+
+		for _, lb := range resp.LoadBalancers {
+			if lb != nil && containsID(lb.SecurityGroups, id) {
+				lbs = append(lbs, aws.StringValue(lb.LoadBalancerArn))
+			}
+		}
+
+		if aws.StringValue(resp.NextMarker) == "" {
+			break
+		}
+		reqv2.Marker = resp.NextMarker
+	}
+
+	return lbs, nil
+}
+
+func containsID(ids []*string, id string) bool {
+	for _, i := range ids {
+		if aws.StringValue(i) == id {
+			return true
+		}
+	}
+	return false
+}
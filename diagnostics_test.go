@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeELB struct {
+	lbs []*elb.LoadBalancerDescription
+}
+
+func (f *fakeELB) DescribeLoadBalancersWithContext(ctx aws.Context, in *elb.DescribeLoadBalancersInput, opts ...request.Option) (*elb.DescribeLoadBalancersOutput, error) {
+	return &elb.DescribeLoadBalancersOutput{LoadBalancerDescriptions: f.lbs}, nil
+}
+
+type fakeELBV2 struct {
+	lbs []*elbv2.LoadBalancer
+}
+
+func (f *fakeELBV2) DescribeLoadBalancersWithContext(ctx aws.Context, in *elbv2.DescribeLoadBalancersInput, opts ...request.Option) (*elbv2.DescribeLoadBalancersOutput, error) {
+	return &elbv2.DescribeLoadBalancersOutput{LoadBalancers: f.lbs}, nil
+}
+
+// useFakeELBs swaps the load balancer client factories, returning a restore func
+func useFakeELBs(classic *fakeELB, v2 *fakeELBV2) func() {
+	originalELB, originalELBV2 := newELBClient, newELBV2Client
+	newELBClient = func(ev *Event) elbClient { return classic }
+	newELBV2Client = func(ev *Event) elbv2Client { return v2 }
+	return func() {
+		newELBClient, newELBV2Client = originalELB, originalELBV2
+	}
+}
+
+func TestLoadBalancerDiagnostics(t *testing.T) {
+	Convey("Given a group still referenced by load balancers", t, func() {
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &fakeEC2{deleteErr: awserr.New("DependencyViolation", "resource has a dependent object", nil)}
+		restore := useFakeEC2(fake)
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+		restoreELBs := useFakeELBs(
+			&fakeELB{lbs: []*elb.LoadBalancerDescription{
+				{LoadBalancerName: aws.String("classic"), SecurityGroups: []*string{aws.String("sg-0000000")}},
+				{LoadBalancerName: aws.String("unrelated"), SecurityGroups: []*string{aws.String("sg-1111111")}},
+			}},
+			&fakeELBV2{lbs: []*elbv2.LoadBalancer{
+				{LoadBalancerArn: aws.String("arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/alb/1"), SecurityGroups: []*string{aws.String("sg-0000000")}},
+			}},
+		)
+
+		Convey("When deleting with diagnostics enabled", func() {
+			cfg.Diagnostics = true
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report the referencing load balancers", func() {
+				So(err, ShouldNotBeNil)
+				So(ev.Dependencies, ShouldNotBeNil)
+				So(ev.Dependencies.LoadBalancers, ShouldResemble, []string{
+					"classic",
+					"arn:aws:elasticloadbalancing:eu-west-1:123456789012:loadbalancer/app/alb/1",
+				})
+			})
+		})
+
+		Convey("When network interfaces and instances also use the group", func() {
+			cfg.Diagnostics = true
+			attached := testENI("vpc-0000000", "sg-0000000")
+			attached.NetworkInterfaceId = aws.String("eni-0000001")
+			attached.Attachment = &ec2.NetworkInterfaceAttachment{InstanceId: aws.String("i-0000001")}
+			fake.interfaces = []*ec2.NetworkInterface{attached, testENI("vpc-0000000", "sg-0000000")}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report every dependency type together", func() {
+				So(err, ShouldNotBeNil)
+				So(ev.Dependencies, ShouldNotBeNil)
+				So(ev.Dependencies.NetworkInterfaces, ShouldResemble, []string{"eni-0000001", "eni-0000000"})
+				So(ev.Dependencies.Instances, ShouldResemble, []string{"i-0000001"})
+				So(ev.Dependencies.LoadBalancers, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When deleting with diagnostics disabled", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not look up dependencies", func() {
+				So(err, ShouldNotBeNil)
+				So(ev.Dependencies, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			newTimer = time.NewTimer
+			restore()
+			restoreELBs()
+		})
+	})
+}
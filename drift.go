@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ruleDrift lists rules that differ between the event and aws
+type ruleDrift struct {
+	Missing    []string `json:"missing,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+}
+
+// defaultEgress is the allow all egress rule aws adds to every group,
+// which events don't usually carry
+var defaultEgress = ruleKey("egress", "-1", 0, 0, "0.0.0.0/0")
+
+// protocolNames are the protocol numbers aws reports by name
+var protocolNames = map[string]string{
+	"6":   "tcp",
+	"17":  "udp",
+	"1":   "icmp",
+	"all": "-1",
+}
+
+// normalRule returns a rule's protocol and ports the way aws reports
+// them: lowercase, named when aws names the protocol, and without ports
+// for protocols that have none
+func normalRule(protocol string, from, to int64) (string, int64, int64) {
+	p := strings.ToLower(protocol)
+	if name, ok := protocolNames[p]; ok {
+		p = name
+	}
+
+	switch p {
+	case "tcp", "udp", "icmp", "icmpv6", "58":
+		return p, from, to
+	}
+	return p, 0, 0
+}
+
+// ruleKey formats a rule so it can be compared and reported, the same
+// rule always giving the same key however the event spells it
+func ruleKey(direction, protocol string, from, to int64, ip string) string {
+	protocol, from, to = normalRule(protocol, from, to)
+	return fmt.Sprintf("%s %s %d-%d %s", direction, protocol, from, to, ip)
+}
+
+// eventRuleKeys returns the keys of the rules carried by the event
+func eventRuleKeys(ev *Event) []string {
+	var keys []string
+
+	for _, r := range ev.SecurityGroupRules.Ingress {
+		keys = append(keys, ruleKey("ingress", r.Protocol, r.FromPort, r.ToPort, r.IP))
+	}
+	for _, r := range ev.SecurityGroupRules.Egress {
+		keys = append(keys, ruleKey("egress", r.Protocol, r.FromPort, r.ToPort, r.IP))
+	}
+
+	return keys
+}
+
+// groupRuleKeys returns the keys of the rules set on a security group,
+// one per ipv4 and ipv6 range
+func groupRuleKeys(sg *ec2.SecurityGroup) []string {
+	var keys []string
+
+	add := func(direction string, perms []*ec2.IpPermission) {
+		for _, p := range perms {
+			if p == nil {
+				continue
+			}
+			key := func(ip string) string {
+				return ruleKey(direction, aws.StringValue(p.IpProtocol), aws.Int64Value(p.FromPort), aws.Int64Value(p.ToPort), ip)
+			}
+			for _, r := range p.IpRanges {
+				if r != nil {
+					keys = append(keys, key(aws.StringValue(r.CidrIp)))
+				}
+			}
+			for _, r := range p.Ipv6Ranges {
+				if r != nil {
+					keys = append(keys, key(aws.StringValue(r.CidrIpv6)))
+				}
+			}
+		}
+	}
+
+	add("ingress", sg.IpPermissions)
+	add("egress", sg.IpPermissionsEgress)
+
+	return keys
+}
+
+// diffRules compares the expected and actual rule keys, returning nil
+// when they match. The default egress rule is only reported as missing,
+// never as unexpected.
+func diffRules(expected, actual []string) *ruleDrift {
+	var drift ruleDrift
+
+	want := make(map[string]bool)
+	for _, k := range expected {
+		want[k] = true
+	}
+
+	have := make(map[string]bool)
+	for _, k := range actual {
+		have[k] = true
+		if !want[k] && k != defaultEgress {
+			drift.Unexpected = append(drift.Unexpected, k)
+		}
+	}
+
+	for _, k := range expected {
+		if !have[k] {
+			drift.Missing = append(drift.Missing, k)
+		}
+	}
+
+	if len(drift.Missing) == 0 && len(drift.Unexpected) == 0 {
+		return nil
+	}
+
+	return &drift
+}
+
+// compareRules records any drift between the event's rules and the
+// group's actual rules
+func (d *deletion) compareRules(id string) {
+	sg, err := d.group(id)
+	if err != nil {
+		log.Printf("Warning: could not compare rules of %s: %s", id, err.Error())
+		return
+	}
+
+	if sg == nil {
+		return
+	}
+
+	d.ev.Drift = diffRules(eventRuleKeys(d.ev), groupRuleKeys(sg))
+}
@@ -0,0 +1,152 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func permission(protocol string, from, to int64, ip string) *ec2.IpPermission {
+	return &ec2.IpPermission{
+		IpProtocol: aws.String(protocol),
+		FromPort:   aws.Int64(from),
+		ToPort:     aws.Int64(to),
+		IpRanges:   []*ec2.IpRange{{CidrIp: aws.String(ip)}},
+	}
+}
+
+func TestCompareRules(t *testing.T) {
+	Convey("Given rule comparison is enabled", t, func() {
+		cfg := defaultConfig()
+		cfg.CompareRules = true
+
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}
+		sg.IpPermissions = []*ec2.IpPermission{permission("tcp", 80, 8080, "10.0.10.100/32")}
+		sg.IpPermissionsEgress = []*ec2.IpPermission{permission("tcp", 80, 8080, "8.8.8.8/32")}
+		fake.groups = []*ec2.SecurityGroup{sg}
+
+		Convey("When the group matches the event", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not report drift", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift, ShouldBeNil)
+			})
+		})
+
+		Convey("When the group has a rule the event doesn't", func() {
+			sg.IpPermissions = append(sg.IpPermissions, permission("tcp", 22, 22, "0.0.0.0/0"))
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report the unexpected rule", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift, ShouldNotBeNil)
+				So(ev.Drift.Unexpected, ShouldResemble, []string{"ingress tcp 22-22 0.0.0.0/0"})
+				So(ev.Drift.Missing, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the event has a rule the group doesn't", func() {
+			sg.IpPermissionsEgress = nil
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report the missing rule", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift.Missing, ShouldResemble, []string{"egress tcp 80-8080 8.8.8.8/32"})
+				So(ev.Drift.Unexpected, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the group belongs to another vpc", func() {
+			sg.VpcId = aws.String("vpc-1111111")
+			sg.IpPermissions = append(sg.IpPermissions, permission("tcp", 22, 22, "0.0.0.0/0"))
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should refuse before comparing its rules", func() {
+				So(err, ShouldEqual, ErrSGVPCMismatch)
+				So(ev.Drift, ShouldBeNil)
+			})
+		})
+
+		Convey("When the group has the default egress rule", func() {
+			sg.IpPermissionsEgress = append(sg.IpPermissionsEgress, &ec2.IpPermission{
+				IpProtocol: aws.String("-1"),
+				IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			})
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not report it as drift", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift, ShouldBeNil)
+			})
+		})
+
+		Convey("When the event lists the default egress rule but the group doesn't have it", func() {
+			ev.SecurityGroupRules.Egress = append(ev.SecurityGroupRules.Egress, rule{IP: "0.0.0.0/0", Protocol: "-1"})
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report it as missing", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift.Missing, ShouldResemble, []string{"egress -1 0-0 0.0.0.0/0"})
+			})
+		})
+
+		Convey("When the event spells the group's rules with mixed case and numeric protocols", func() {
+			ev.SecurityGroupRules.Ingress = []rule{
+				{IP: "10.0.10.100/32", FromPort: 80, ToPort: 8080, Protocol: "TCP"},
+				{IP: "10.0.20.0/24", FromPort: 53, ToPort: 53, Protocol: "17"},
+				{IP: "2001:db8::/64", FromPort: 443, ToPort: 443, Protocol: "6"},
+			}
+			ev.SecurityGroupRules.Egress = []rule{
+				{IP: "8.8.8.8/32", FromPort: 80, ToPort: 8080, Protocol: "Tcp"},
+				{IP: "0.0.0.0/0", FromPort: -1, ToPort: -1, Protocol: "all"},
+			}
+			sg.IpPermissions = append(sg.IpPermissions, permission("udp", 53, 53, "10.0.20.0/24"), &ec2.IpPermission{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int64(443),
+				ToPort:     aws.Int64(443),
+				Ipv6Ranges: []*ec2.Ipv6Range{{CidrIpv6: aws.String("2001:db8::/64")}},
+			})
+			sg.IpPermissionsEgress = append(sg.IpPermissionsEgress, &ec2.IpPermission{
+				IpProtocol: aws.String("-1"),
+				IpRanges:   []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			})
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not report drift", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift, ShouldBeNil)
+			})
+		})
+
+		Convey("When the group has an ipv6 rule the event doesn't", func() {
+			sg.IpPermissions = append(sg.IpPermissions, &ec2.IpPermission{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int64(22),
+				ToPort:     aws.Int64(22),
+				Ipv6Ranges: []*ec2.Ipv6Range{{CidrIpv6: aws.String("::/0")}},
+			})
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report the unexpected rule", func() {
+				So(err, ShouldBeNil)
+				So(ev.Drift.Unexpected, ShouldResemble, []string{"ingress tcp 22-22 ::/0"})
+			})
+		})
+
+		Reset(restore)
+	})
+}
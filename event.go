@@ -7,20 +7,35 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
 )
 
 var (
 	ErrDatacenterIDInvalid          = errors.New("Datacenter VPC ID invalid")
 	ErrDatacenterRegionInvalid      = errors.New("Datacenter Region invalid")
 	ErrDatacenterCredentialsInvalid = errors.New("Datacenter credentials invalid")
-	ErrSGAWSIDInvalid               = errors.New("Security Group aws id invalid")
+	ErrDatacenterPartitionInvalid   = errors.New("Datacenter partition invalid, use aws, aws-us-gov or aws-cn")
+	ErrSGAWSIDInvalid               = errors.New("Security Group aws id missing, set security_group_aws_id, security_group_aws_ids or network_interface_id")
 	ErrSGNameInvalid                = errors.New("Security Group name invalid")
 	ErrSGRulesInvalid               = errors.New("Security Group must contain rules")
 	ErrSGRuleIPInvalid              = errors.New("Security Group rule ip invalid")
 	ErrSGRuleProtocolInvalid        = errors.New("Security Group rule protocol invalid")
 	ErrSGRuleFromPortInvalid        = errors.New("Security Group rule from port invalid")
 	ErrSGRuleToPortInvalid          = errors.New("Security Group rule to port invalid")
+	ErrSGRulePortsUnsupported       = errors.New("Security Group rule ports are not supported by its protocol")
+)
+
+// error categories, telling consumers where a failure came from
+const (
+	categoryTransport  = "transport"
+	categoryValidation = "validation"
+	categoryAWS        = "aws"
 )
 
 type rule struct {
@@ -28,25 +43,215 @@ type rule struct {
 	FromPort int64  `json:"from_port"`
 	ToPort   int64  `json:"to_port"`
 	Protocol string `json:"protocol"`
+
+	// err records a port that could not be read, reported on validation
+	err error
+}
+
+// UnmarshalJSON accepts ports encoded as numbers or numeric strings
+func (r *rule) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		IP       string          `json:"ip"`
+		FromPort json.RawMessage `json:"from_port"`
+		ToPort   json.RawMessage `json:"to_port"`
+		Protocol string          `json:"protocol"`
+	}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	r.IP = raw.IP
+	r.Protocol = raw.Protocol
+	r.err = nil
+
+	var ok bool
+	if r.FromPort, ok = parsePort(raw.FromPort); !ok {
+		r.err = ErrSGRuleFromPortInvalid
+	}
+	if r.ToPort, ok = parsePort(raw.ToPort); !ok && r.err == nil {
+		r.err = ErrSGRuleToPortInvalid
+	}
+
+	return nil
+}
+
+// validate checks a single rule, rejecting ports on protocols without
+// them when strict
+func (r rule) validate(strict bool) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if _, _, err := net.ParseCIDR(r.IP); err != nil {
+		return ErrSGRuleIPInvalid
+	}
+
+	switch strings.ToLower(r.Protocol) {
+	case "tcp", "udp", "6", "17":
+		return validRange(r.FromPort, r.ToPort, 1, 65535)
+	case "icmp", "icmpv6", "1", "58":
+		// ports carry the icmp type and code, -1 meaning all
+		return validRange(r.FromPort, r.ToPort, -1, 255)
+	case "-1", "all":
+		return r.noPorts(strict)
+	}
+
+	// other protocols are given by number and have no ports
+	if n, err := strconv.Atoi(r.Protocol); err == nil && n >= 0 && n <= 255 {
+		return r.noPorts(strict)
+	}
+
+	return ErrSGRuleProtocolInvalid
+}
+
+// noPorts checks a rule of a protocol without ports leaves them unset,
+// either zero or -1, when strict
+func (r rule) noPorts(strict bool) error {
+	if !strict {
+		return nil
+	}
+
+	unset := func(p int64) bool { return p == 0 || p == -1 }
+	if !unset(r.FromPort) || !unset(r.ToPort) {
+		return ErrSGRulePortsUnsupported
+	}
+
+	return nil
+}
+
+// validRange checks a rule's ports are within min and max, with the
+// tcp and udp range ordered. ICMP type and code are independent.
+func validRange(from, to, min, max int64) error {
+	if from < min || from > max {
+		return ErrSGRuleFromPortInvalid
+	}
+
+	if to < min || to > max || (min > 0 && to < from) {
+		return ErrSGRuleToPortInvalid
+	}
+
+	return nil
+}
+
+// ruleErrors lists every invalid rule of an event
+type ruleErrors []string
+
+func (e ruleErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// validateRules checks the event's rules, returning the first error or,
+// when aggregating, all of them
+func (ev *Event) validateRules() error {
+	var errs ruleErrors
+
+	rules := []struct {
+		direction string
+		rules     []rule
+	}{
+		{"ingress", ev.SecurityGroupRules.Ingress},
+		{"egress", ev.SecurityGroupRules.Egress},
+	}
+
+	for _, set := range rules {
+		for i, r := range set.rules {
+			err := r.validate(ev.cfg.StrictRulePorts)
+			if err == nil {
+				continue
+			}
+			if !ev.cfg.AggregateRuleErrors {
+				return err
+			}
+			errs = append(errs, fmt.Sprintf("%s rule %d: %s", set.direction, i+1, err.Error()))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// parsePort reads a port given as a number or a numeric string
+func parsePort(raw json.RawMessage) (int64, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, true
+	}
+
+	var n int64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, true
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
 }
 
 // Event stores the firewall data
 type Event struct {
-	UUID                  string `json:"_uuid"`
-	BatchID               string `json:"_batch_id"`
-	ProviderType          string `json:"_type"`
-	VPCID                 string `json:"vpc_id"`
-	DatacenterRegion      string `json:"datacenter_region"`
-	DatacenterAccessKey   string `json:"datacenter_secret"`
-	DatacenterAccessToken string `json:"datacenter_token"`
-	NetworkAWSID          string `json:"network_aws_id"`
-	SecurityGroupAWSID    string `json:"security_group_aws_id,omitempty"`
-	SecurityGroupName     string `json:"security_group_name"`
-	SecurityGroupRules    struct {
+	UUID                    string   `json:"_uuid"`
+	BatchID                 string   `json:"_batch_id"`
+	ProviderType            string   `json:"_type"`
+	VPCID                   string   `json:"vpc_id"`
+	DatacenterRegion        string   `json:"datacenter_region"`
+	DatacenterAccessKey     string   `json:"datacenter_secret"`
+	DatacenterAccessToken   string   `json:"datacenter_token"`
+	DatacenterSessionToken  string   `json:"datacenter_access_session_token,omitempty"`
+	DatacenterAssumeRoleARN string   `json:"datacenter_assume_role_arn,omitempty"`
+	DatacenterExternalID    string   `json:"datacenter_external_id,omitempty"`
+	DatacenterProfile       string   `json:"datacenter_profile,omitempty"`
+	DatacenterPartition     string   `json:"datacenter_partition,omitempty"`
+	NetworkAWSID            string   `json:"network_aws_id"`
+	SecurityGroupAWSID      string   `json:"security_group_aws_id,omitempty"`
+	SecurityGroupName       string   `json:"security_group_name"`
+	NetworkInterfaceID      string   `json:"network_interface_id,omitempty"`
+	SecurityGroupAWSIDs     []string `json:"security_group_aws_ids,omitempty"`
+	Recreate                bool     `json:"recreate,omitempty"`
+	Priority                string   `json:"priority,omitempty"`
+	Revoke                  *bool    `json:"revoke_before_delete,omitempty"`
+	Explain                 bool     `json:"explain,omitempty"`
+	PlanID                  string   `json:"plan_id,omitempty"`
+	SecurityGroupRules      struct {
 		Ingress []rule `json:"ingress"`
 		Egress  []rule `json:"egress"`
 	} `json:"security_group_rules"`
-	ErrorMessage string `json:"error,omitempty"`
+	Status             string            `json:"status,omitempty"`
+	DeletedIDs         []string          `json:"deleted_ids,omitempty"`
+	AlreadyDeleted     []string          `json:"already_deleted,omitempty"`
+	RevokedRules       int               `json:"revoked_rules,omitempty"`
+	Retries            int               `json:"retries,omitempty"`
+	DurationMS         int64             `json:"duration_ms,omitempty"`
+	ClientRequestToken string            `json:"client_request_token,omitempty"`
+	TimingsMS          map[string]int64  `json:"timings,omitempty"`
+	Results            []groupResult     `json:"results,omitempty"`
+	Dependencies       *dependencies     `json:"dependencies,omitempty"`
+	Drift              *ruleDrift        `json:"drift,omitempty"`
+	PerformedByARN     string            `json:"performed_by_arn,omitempty"`
+	AccountID          string            `json:"account_id,omitempty"`
+	Region             string            `json:"region,omitempty"`
+	ErrorCode          string            `json:"error_code,omitempty"`
+	ErrorCategory      string            `json:"error_category,omitempty"`
+	ErrorMessage       string            `json:"error,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	Trace              []string          `json:"trace,omitempty"`
+	PlanExpiresAt      string            `json:"plan_expires_at,omitempty"`
+
+	cfg   *Config
+	creds *credentials.Credentials
+	reply string
+	// raw is the payload the event was read from, kept to retry it
+	raw []byte
 }
 
 // Validate checks if all criteria are met
@@ -59,43 +264,232 @@ func (ev *Event) Validate() error {
 		return ErrDatacenterRegionInvalid
 	}
 
-	if ev.DatacenterAccessKey == "" || ev.DatacenterAccessToken == "" {
+	if _, ok := partitions[ev.DatacenterPartition]; ev.DatacenterPartition != "" && !ok {
+		return ErrDatacenterPartitionInvalid
+	}
+
+	// credentials may come from a role, a profile or the default chain,
+	// but static keys must be complete
+	if (ev.DatacenterAccessKey == "") != (ev.DatacenterAccessToken == "") {
 		return ErrDatacenterCredentialsInvalid
 	}
 
-	if ev.SecurityGroupAWSID == "" {
+	if ev.SecurityGroupAWSID == "" && ev.NetworkInterfaceID == "" && len(ev.SecurityGroupAWSIDs) == 0 && !ev.byName() {
 		return ErrSGAWSIDInvalid
 	}
 
-	return nil
+	if ev.cfg.RequireName && ev.SecurityGroupName == "" {
+		return ErrSGNameInvalid
+	}
+
+	if ev.cfg.RequireRules && !ev.hasRules() {
+		return ErrSGRulesInvalid
+	}
+
+	return ev.validateRules()
+}
+
+// applyDefaults fills fields legacy producers omit
+func (ev *Event) applyDefaults() {
+	if ev.VPCID == "" && ev.cfg.DefaultVPCID != "" {
+		log.Printf("event has no vpc id, assuming %s", ev.cfg.DefaultVPCID)
+		ev.VPCID = ev.cfg.DefaultVPCID
+	}
+}
+
+// hasRules checks if the event lists any ingress or egress rule
+func (ev *Event) hasRules() bool {
+	return len(ev.SecurityGroupRules.Ingress) > 0 || len(ev.SecurityGroupRules.Egress) > 0
+}
+
+// highPriority checks if the event asked for an elevated retry budget,
+// the reserved worker and the reserved client slot
+func (ev *Event) highPriority() bool {
+	return ev.Priority == "high"
+}
+
+// prioritized checks if a raw event asked for high priority, so it can
+// take the reserved worker before being processed
+func prioritized(data []byte) bool {
+	var ev struct {
+		Priority string `json:"priority"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return false
+	}
+	return ev.Priority == "high"
+}
+
+// target describes the group or groups the event deletes
+func (ev *Event) target() string {
+	switch {
+	case len(ev.SecurityGroupAWSIDs) > 0:
+		return strings.Join(ev.SecurityGroupAWSIDs, ", ")
+	case ev.byName():
+		return "named " + ev.SecurityGroupName
+	case ev.SecurityGroupAWSID == "":
+		return "attached to " + ev.NetworkInterfaceID
+	}
+	return ev.SecurityGroupAWSID
+}
+
+// unreadable reports a message that could not be parsed as an event
+type unreadable struct {
+	Status        string `json:"status"`
+	ErrorMessage  string `json:"error"`
+	ErrorCategory string `json:"error_category"`
+	Payload       string `json:"payload"`
 }
 
 // Process the raw event
 func (ev *Event) Process(data []byte) error {
+	ev.raw = data
 	err := json.Unmarshal(data, &ev)
-	if err != nil {
-		nc.Publish("firewall.delete.aws.error", data)
+
+	switch {
+	case err == nil:
+	case malformed(err):
+		rejectMalformed(ev.cfg, deleteSubject(ev.cfg), ev.reply, data, err)
+	default:
+		log.Printf("Error: %s", err.Error())
+		msg, merr := json.Marshal(unreadable{
+			Status:        statusFailed,
+			ErrorMessage:  err.Error(),
+			ErrorCategory: categoryTransport,
+			Payload:       string(data),
+		})
+		if merr != nil {
+			log.Panic(merr)
+		}
+		publish(ev.cfg, ev.cfg.ErrorSubject, msg)
+		ev.respond(msg)
 	}
 	return err
 }
 
+// respond sends the result to the requester when the event was a request
+func (ev *Event) respond(data []byte) {
+	if ev.reply != "" {
+		publishReply(ev.cfg, ev.reply, data)
+	}
+}
+
 // Error the request
 func (ev *Event) Error(err error) {
+	ev.fail(ev.cfg.ErrorSubject, errorCategory(err), err)
+}
+
+// Invalid rejects a request that failed validation
+func (ev *Event) Invalid(err error) {
+	ev.fail(ev.cfg.ValidationErrorSubject, categoryValidation, err)
+}
+
+func (ev *Event) fail(subject, category string, err error) {
 	log.Printf("Error: %s", err.Error())
+	if ev.Status == "" {
+		ev.Status = statusFailed
+	}
 	ev.ErrorMessage = err.Error()
+	ev.ErrorCode = resultCode(err)
+	ev.ErrorCategory = category
+	ev.Region = ev.DatacenterRegion
+	ev.enrich()
 
-	data, err := json.Marshal(ev)
+	data, err := json.Marshal(failedResult{Event: ev, SecurityGroupAWSID: ev.SecurityGroupAWSID})
 	if err != nil {
 		log.Panic(err)
 	}
-	nc.Publish("firewall.delete.aws.error", data)
+	dispatch(ev.cfg, subject, data)
+	ev.respond(data)
+	audit(ev, "failed")
+	if ev.cfg.ReprocessFailed {
+		failedEvents.put(ev.UUID, ev.raw, ev.cfg.ReprocessTTL, ev.cfg.ReprocessSize)
+	}
+}
+
+// ack is the minimal done payload
+type ack struct {
+	UUID               string            `json:"_uuid"`
+	BatchID            string            `json:"_batch_id"`
+	ProviderType       string            `json:"_type"`
+	SecurityGroupAWSID string            `json:"security_group_aws_id,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// explicitResult marshals an event with its error and status keys
+// always present
+type explicitResult struct {
+	*Event
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error"`
+}
+
+// failedResult marshals a failed event with its security group id always
+// present, so a missing id shows as empty rather than absent
+type failedResult struct {
+	*Event
+	SecurityGroupAWSID string `json:"security_group_aws_id"`
+}
+
+// donePayload builds the done message according to DonePayload
+func (ev *Event) donePayload() ([]byte, error) {
+	switch ev.cfg.DonePayload {
+	case "minimal":
+		return json.Marshal(ack{
+			UUID:               ev.UUID,
+			BatchID:            ev.BatchID,
+			ProviderType:       ev.ProviderType,
+			SecurityGroupAWSID: ev.SecurityGroupAWSID,
+			Metadata:           ev.Metadata,
+		})
+	case "empty":
+		return []byte{}, nil
+	}
+
+	if ev.cfg.ExplicitResultFields {
+		return json.Marshal(explicitResult{Event: ev, Status: ev.Status, ErrorMessage: ev.ErrorMessage})
+	}
+
+	return json.Marshal(ev)
+}
+
+// enrich adds the configured metadata to the event, keeping any values
+// the event already carries
+func (ev *Event) enrich() {
+	for k, v := range ev.cfg.ResultMetadata {
+		if ev.Metadata == nil {
+			ev.Metadata = make(map[string]string)
+		}
+		if _, ok := ev.Metadata[k]; !ok {
+			ev.Metadata[k] = v
+		}
+	}
+}
+
+// report publishes a result that deleted nothing on its own subject and
+// to the requester. It is not a terminal result, so it skips the result
+// sinks and the audit.
+func (ev *Event) report(subject string) {
+	ev.enrich()
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		ev.Error(err)
+		return
+	}
+	publish(ev.cfg, subject, data)
+	ev.respond(data)
 }
 
 // Complete the request
 func (ev *Event) Complete() {
-	data, err := json.Marshal(ev)
+	ev.enrich()
+
+	data, err := ev.donePayload()
 	if err != nil {
 		ev.Error(err)
 	}
-	nc.Publish("firewall.delete.aws.done", data)
+	dispatch(ev.cfg, shardSubject(ev.cfg.DoneSubject, ev.UUID, ev.cfg.ResultShards), data)
+	ev.respond(data)
+	audit(ev, "completed")
 }
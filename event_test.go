@@ -7,12 +7,14 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	ecc "github.com/ernestio/ernest-config-client"
 	"github.com/nats-io/nats"
 
@@ -30,6 +32,7 @@ var (
 		DatacenterAccessToken: "token",
 		SecurityGroupAWSID:    "sg-0000000",
 		SecurityGroupName:     "test",
+		cfg:                   defaultConfig(),
 	}
 )
 
@@ -46,10 +49,10 @@ func testSetup() (chan *nats.Msg, chan *nats.Msg) {
 	doneChan := make(chan *nats.Msg, 10)
 	errChan := make(chan *nats.Msg, 10)
 
-	nc = ecc.NewConfig(os.Getenv("NATS_URI")).Nats()
+	setConn(ecc.NewConfig(testNatsURI()).Nats())
 
-	nc.ChanSubscribe("firewall.delete.aws.done", doneChan)
-	nc.ChanSubscribe("firewall.delete.aws.error", errChan)
+	conn().ChanSubscribe("firewall.delete.aws.done", doneChan)
+	conn().ChanSubscribe("firewall.delete.aws.error", errChan)
 
 	return doneChan, errChan
 }
@@ -77,11 +80,13 @@ func TestEvent(t *testing.T) {
 	completed, errored := testSetup()
 
 	Convey("Given an event", t, func() {
+		cfg := defaultConfig()
+
 		Convey("With valid fields", func() {
 			buildTestRules(&testEvent)
 			valid, _ := json.Marshal(testEvent)
 			Convey("When processing the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				err := e.Process(valid)
 
 				Convey("It should not error", func() {
@@ -114,7 +119,7 @@ func TestEvent(t *testing.T) {
 			})
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(valid)
 				err := e.Validate()
 
@@ -127,7 +132,7 @@ func TestEvent(t *testing.T) {
 			})
 
 			Convey("When completing the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(valid)
 				e.Complete()
 				Convey("It should produce a firewall.delete.aws.done event", func() {
@@ -141,9 +146,79 @@ func TestEvent(t *testing.T) {
 				})
 			})
 
+			Convey("When completing the event with a minimal done payload", func() {
+				cfg.DonePayload = "minimal"
+				e := Event{cfg: cfg}
+				e.Process(valid)
+				e.Complete()
+				Convey("It should only publish the identifying fields", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldEqual, `{"_uuid":"test","_batch_id":"test","_type":"aws","security_group_aws_id":"sg-0000000"}`)
+				})
+			})
+
+			Convey("When completing the event with an empty done payload", func() {
+				cfg.DonePayload = "empty"
+				e := Event{cfg: cfg}
+				e.Process(valid)
+				e.Complete()
+				Convey("It should publish an empty message", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(msg.Data, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When completing the event with explicit result fields", func() {
+				cfg.ExplicitResultFields = true
+				e := Event{cfg: cfg}
+				e.Process(valid)
+				e.Complete()
+				Convey("It should include empty error and status keys", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldEndWith, `,"status":"","error":""}`)
+
+					var fields map[string]interface{}
+					So(json.Unmarshal(msg.Data, &fields), ShouldBeNil)
+					So(fields, ShouldContainKey, "error")
+					So(fields, ShouldContainKey, "status")
+				})
+			})
+
+			Convey("When completing the event without explicit result fields", func() {
+				e := Event{cfg: cfg}
+				e.Process(valid)
+				e.Complete()
+				Convey("It should leave out the empty error and status keys", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+
+					var fields map[string]interface{}
+					So(json.Unmarshal(msg.Data, &fields), ShouldBeNil)
+					So(fields, ShouldNotContainKey, "error")
+					So(fields, ShouldNotContainKey, "status")
+				})
+			})
+
+			Convey("When completing an event flagged for recreation", func() {
+				e := testEvent
+				e.Recreate = true
+				data, _ := json.Marshal(e)
+				r := Event{cfg: cfg}
+				r.Process(data)
+				r.Complete()
+				Convey("It should pass the flag through to the done event", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldContainSubstring, `"recreate":true`)
+				})
+			})
+
 			Convey("When erroring the event", func() {
 				log.SetOutput(ioutil.Discard)
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(valid)
 				e.Error(errors.New("error"))
 				Convey("It should produce a firewall.delete.aws.error event", func() {
@@ -159,13 +234,42 @@ func TestEvent(t *testing.T) {
 			})
 		})
 
+		Convey("When erroring with an aws failure", func() {
+			log.SetOutput(ioutil.Discard)
+			e := testEvent
+			e.Error(awserr.New("DependencyViolation", "resource sg-0000000 has a dependent object", nil))
+			log.SetOutput(os.Stdout)
+
+			Convey("It should include the error context", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"region":"eu-west-1"`)
+				So(string(msg.Data), ShouldContainSubstring, `"security_group_aws_id":"sg-0000000"`)
+				So(string(msg.Data), ShouldContainSubstring, `"vpc_id":"vpc-0000000"`)
+				So(string(msg.Data), ShouldContainSubstring, `"error_code":"DependencyViolation"`)
+			})
+		})
+
+		Convey("When erroring with a non aws failure", func() {
+			log.SetOutput(ioutil.Discard)
+			e := testEvent
+			e.Error(errors.New("error"))
+			log.SetOutput(os.Stdout)
+
+			Convey("It should omit the error code", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldNotContainSubstring, `"error_code"`)
+			})
+		})
+
 		Convey("With no datacenter vpc id", func() {
 			testEventInvalid := testEvent
 			testEventInvalid.VPCID = ""
 			invalid, _ := json.Marshal(testEventInvalid)
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(invalid)
 				err := e.Validate()
 				Convey("It should error", func() {
@@ -173,6 +277,41 @@ func TestEvent(t *testing.T) {
 					So(err.Error(), ShouldEqual, "Datacenter VPC ID invalid")
 				})
 			})
+
+			Convey("When a default vpc id is configured", func() {
+				cfg.DefaultVPCID = "vpc-0000000"
+				e := Event{cfg: cfg}
+				e.Process(invalid)
+				e.applyDefaults()
+				err := e.Validate()
+
+				Convey("It should assume the default vpc", func() {
+					So(err, ShouldBeNil)
+					So(e.VPCID, ShouldEqual, "vpc-0000000")
+				})
+			})
+
+			Convey("When no default vpc id is configured", func() {
+				e := Event{cfg: cfg}
+				e.Process(invalid)
+				e.applyDefaults()
+				err := e.Validate()
+
+				Convey("It should still error", func() {
+					So(err, ShouldEqual, ErrDatacenterIDInvalid)
+				})
+			})
+		})
+
+		Convey("With a datacenter vpc id and a default", func() {
+			cfg.DefaultVPCID = "vpc-1111111"
+			e := testEvent
+			e.cfg = cfg
+			e.applyDefaults()
+
+			Convey("It should keep the event's vpc id", func() {
+				So(e.VPCID, ShouldEqual, "vpc-0000000")
+			})
 		})
 
 		Convey("With no datacenter region", func() {
@@ -181,7 +320,7 @@ func TestEvent(t *testing.T) {
 			invalid, _ := json.Marshal(testEventInvalid)
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(invalid)
 				err := e.Validate()
 				Convey("It should error", func() {
@@ -197,7 +336,7 @@ func TestEvent(t *testing.T) {
 			invalid, _ := json.Marshal(testEventInvalid)
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(invalid)
 				err := e.Validate()
 				Convey("It should error", func() {
@@ -213,7 +352,7 @@ func TestEvent(t *testing.T) {
 			invalid, _ := json.Marshal(testEventInvalid)
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(invalid)
 				err := e.Validate()
 				Convey("It should error", func() {
@@ -223,20 +362,310 @@ func TestEvent(t *testing.T) {
 			})
 		})
 
+		Convey("With no security group name", func() {
+			testEventInvalid := testEvent
+			testEventInvalid.SecurityGroupName = ""
+			invalid, _ := json.Marshal(testEventInvalid)
+
+			Convey("When validating the event with names required", func() {
+				cfg.RequireName = true
+				e := Event{cfg: cfg}
+				e.Process(invalid)
+				err := e.Validate()
+				Convey("It should error", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "Security Group name invalid")
+				})
+			})
+
+			Convey("When validating the event with names optional", func() {
+				e := Event{cfg: cfg}
+				e.Process(invalid)
+				err := e.Validate()
+				Convey("It should not error", func() {
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+
 		Convey("With no security group id", func() {
 			testEventInvalid := testEvent
 			testEventInvalid.SecurityGroupAWSID = ""
 			invalid, _ := json.Marshal(testEventInvalid)
 
 			Convey("When validating the event", func() {
-				var e Event
+				e := Event{cfg: cfg}
 				e.Process(invalid)
 				err := e.Validate()
 				Convey("It should error", func() {
 					So(err, ShouldNotBeNil)
-					So(err.Error(), ShouldEqual, "Security Group aws id invalid")
+					So(err.Error(), ShouldStartWith, "Security Group aws id missing")
 				})
 			})
 		})
 	})
 }
+
+func TestSessionToken(t *testing.T) {
+	Convey("Given an event carrying temporary credentials", t, func() {
+		log.SetOutput(ioutil.Discard)
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.DatacenterSessionToken = "session"
+		data, _ := json.Marshal(ev)
+
+		Convey("When processing the event", func() {
+			e := Event{cfg: cfg}
+			err := e.Process(data)
+			creds, cerr := credentialsFor(&e).Get()
+
+			Convey("It should sign with the session token", func() {
+				So(err, ShouldBeNil)
+				So(e.DatacenterSessionToken, ShouldEqual, "session")
+				So(cerr, ShouldBeNil)
+				So(creds.AccessKeyID, ShouldEqual, "key")
+				So(creds.SessionToken, ShouldEqual, "session")
+			})
+		})
+
+		Convey("When the event carries long lived keys", func() {
+			data, _ := json.Marshal(testEvent)
+			e := Event{cfg: cfg}
+			err := e.Process(data)
+			creds, _ := credentialsFor(&e).Get()
+
+			Convey("It should sign without a session token", func() {
+				So(err, ShouldBeNil)
+				So(string(data), ShouldNotContainSubstring, "datacenter_access_session_token")
+				So(creds.SessionToken, ShouldEqual, "")
+			})
+		})
+
+		Reset(func() {
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestRulePorts(t *testing.T) {
+	Convey("Given an event with rules", t, func() {
+		cfg := defaultConfig()
+		event := func(ports string) []byte {
+			return []byte(`{"vpc_id":"vpc-0000000","datacenter_region":"eu-west-1","datacenter_secret":"key","datacenter_token":"token","security_group_aws_id":"sg-0000000","security_group_rules":{"ingress":[{"ip":"10.0.0.0/16","protocol":"tcp",` + ports + `}],"egress":[]}}`)
+		}
+
+		Convey("When the ports are numbers", func() {
+			e := Event{cfg: cfg}
+			err := e.Process(event(`"from_port":80,"to_port":8080`))
+
+			Convey("It should read them", func() {
+				So(err, ShouldBeNil)
+				So(e.Validate(), ShouldBeNil)
+				So(e.SecurityGroupRules.Ingress[0].FromPort, ShouldEqual, 80)
+				So(e.SecurityGroupRules.Ingress[0].ToPort, ShouldEqual, 8080)
+			})
+		})
+
+		Convey("When the ports are numeric strings", func() {
+			e := Event{cfg: cfg}
+			err := e.Process(event(`"from_port":"80","to_port":" 8080"`))
+
+			Convey("It should coerce them", func() {
+				So(err, ShouldBeNil)
+				So(e.Validate(), ShouldBeNil)
+				So(e.SecurityGroupRules.Ingress[0].FromPort, ShouldEqual, 80)
+				So(e.SecurityGroupRules.Ingress[0].ToPort, ShouldEqual, 8080)
+			})
+		})
+
+		Convey("When the from port is not a number", func() {
+			e := Event{cfg: cfg}
+			err := e.Process(event(`"from_port":"http","to_port":8080`))
+
+			Convey("It should fail validation", func() {
+				So(err, ShouldBeNil)
+				So(e.Validate(), ShouldEqual, ErrSGRuleFromPortInvalid)
+			})
+		})
+
+		Convey("When the to port is not a number", func() {
+			e := Event{cfg: cfg}
+			err := e.Process(event(`"from_port":80,"to_port":true`))
+
+			Convey("It should fail validation", func() {
+				So(err, ShouldBeNil)
+				So(e.Validate(), ShouldEqual, ErrSGRuleToPortInvalid)
+			})
+		})
+	})
+}
+
+func TestRequireRules(t *testing.T) {
+	Convey("Given an event", t, func() {
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+
+		Convey("When rules are not required", func() {
+			ev.SecurityGroupRules.Ingress = nil
+			ev.SecurityGroupRules.Egress = nil
+
+			Convey("It should validate without rules", func() {
+				So(ev.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("When rules are required", func() {
+			cfg.RequireRules = true
+
+			Convey("It should error without ingress or egress rules", func() {
+				ev.SecurityGroupRules.Ingress = nil
+				ev.SecurityGroupRules.Egress = nil
+				So(ev.Validate(), ShouldEqual, ErrSGRulesInvalid)
+			})
+
+			Convey("It should validate with only ingress rules", func() {
+				ev.SecurityGroupRules.Egress = nil
+				So(ev.Validate(), ShouldBeNil)
+			})
+
+			Convey("It should validate with only egress rules", func() {
+				ev.SecurityGroupRules.Ingress = nil
+				So(ev.Validate(), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestRuleCount(t *testing.T) {
+	Convey("Given rules are required", t, func() {
+		cfg := defaultConfig()
+		cfg.RequireRules = true
+		ingress := []rule{{IP: "10.0.10.100/32", FromPort: 80, ToPort: 8080, Protocol: "tcp"}}
+		egress := []rule{{IP: "8.8.8.8/32", FromPort: 80, ToPort: 8080, Protocol: "tcp"}}
+
+		tests := []struct {
+			desc            string
+			ingress, egress []rule
+			err             error
+		}{
+			{"only ingress rules", ingress, nil, nil},
+			{"only egress rules", nil, egress, nil},
+			{"both ingress and egress rules", ingress, egress, nil},
+			{"neither ingress nor egress rules", nil, nil, ErrSGRulesInvalid},
+		}
+
+		for _, tt := range tests {
+			ev := testEvent
+			ev.cfg = cfg
+			ev.SecurityGroupRules.Ingress = tt.ingress
+			ev.SecurityGroupRules.Egress = tt.egress
+
+			Convey("When validating an event with "+tt.desc, func() {
+				So(ev.Validate(), ShouldEqual, tt.err)
+			})
+		}
+	})
+}
+
+func TestRuleValidation(t *testing.T) {
+	Convey("Given an event with several invalid rules", t, func() {
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		ev.SecurityGroupRules.Ingress[0].IP = "10.0.10.100"
+		ev.SecurityGroupRules.Egress[0].Protocol = ""
+		ev.SecurityGroupRules.Egress = append(ev.SecurityGroupRules.Egress, rule{IP: "0.0.0.0/0", Protocol: "tcp", FromPort: 80, ToPort: 70000})
+
+		Convey("When validating with the default mode", func() {
+			err := ev.Validate()
+
+			Convey("It should return the first error", func() {
+				So(err, ShouldEqual, ErrSGRuleIPInvalid)
+			})
+		})
+
+		Convey("When validating with errors aggregated", func() {
+			cfg.AggregateRuleErrors = true
+			err := ev.Validate()
+
+			Convey("It should return every error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEqual, "ingress rule 1: Security Group rule ip invalid; egress rule 1: Security Group rule protocol invalid; egress rule 2: Security Group rule to port invalid")
+			})
+		})
+	})
+}
+
+func TestRuleProtocols(t *testing.T) {
+	Convey("Given rules of every protocol", t, func() {
+		tests := []struct {
+			protocol string
+			from, to int64
+			err      error
+		}{
+			{"tcp", 80, 8080, nil},
+			{"tcp", 1, 65535, nil},
+			{"tcp", 0, 80, ErrSGRuleFromPortInvalid},
+			{"tcp", 80, 65536, ErrSGRuleToPortInvalid},
+			{"tcp", 8080, 80, ErrSGRuleToPortInvalid},
+			{"udp", 53, 53, nil},
+			{"udp", -1, 53, ErrSGRuleFromPortInvalid},
+			{"UDP", 53, 53, nil},
+			{"icmp", 8, 0, nil},
+			{"icmp", -1, -1, nil},
+			{"icmp", 256, 0, ErrSGRuleFromPortInvalid},
+			{"icmp", 3, 256, ErrSGRuleToPortInvalid},
+			{"icmpv6", 128, 0, nil},
+			{"-1", 0, 0, nil},
+			{"-1", -1, 70000, nil},
+			{"all", 0, 0, nil},
+			{"50", 0, 0, nil},
+			{"256", 0, 0, ErrSGRuleProtocolInvalid},
+			{"sctp", 0, 0, ErrSGRuleProtocolInvalid},
+			{"", 80, 80, ErrSGRuleProtocolInvalid},
+		}
+
+		for _, tt := range tests {
+			r := rule{IP: "10.0.0.0/16", Protocol: tt.protocol, FromPort: tt.from, ToPort: tt.to}
+
+			Convey(fmt.Sprintf("When validating %q %d-%d", tt.protocol, tt.from, tt.to), func() {
+				So(r.validate(false), ShouldEqual, tt.err)
+			})
+		}
+	})
+}
+
+func TestStrictRulePorts(t *testing.T) {
+	Convey("Given strict rule ports are enabled", t, func() {
+
+		tests := []struct {
+			protocol string
+			from, to int64
+			err      error
+		}{
+			{"-1", 0, 0, nil},
+			{"-1", -1, -1, nil},
+			{"all", 0, -1, nil},
+			{"-1", 80, 80, ErrSGRulePortsUnsupported},
+			{"-1", -1, 70000, ErrSGRulePortsUnsupported},
+			{"all", 0, 443, ErrSGRulePortsUnsupported},
+			{"50", 0, 0, nil},
+			{"50", 500, 500, ErrSGRulePortsUnsupported},
+			{"tcp", 0, 0, ErrSGRuleFromPortInvalid},
+			{"udp", 53, 0, ErrSGRuleToPortInvalid},
+			{"tcp", 22, 22, nil},
+			{"icmp", -1, -1, nil},
+		}
+
+		for _, tt := range tests {
+			r := rule{IP: "10.0.0.0/16", Protocol: tt.protocol, FromPort: tt.from, ToPort: tt.to}
+
+			Convey(fmt.Sprintf("When validating %q %d-%d", tt.protocol, tt.from, tt.to), func() {
+				So(r.validate(true), ShouldEqual, tt.err)
+			})
+		}
+	})
+}
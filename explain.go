@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// explain reports every decision the connector would make for the
+// event, and the aws calls it would issue, without calling aws. The
+// trace goes to the explain subject rather than the done one, and is not
+// audited, as nothing was deleted.
+func explain(ev *Event) {
+	log.Printf("explain: tracing deletion of security group %s", ev.target())
+
+	ev.Trace = ev.trace()
+	ev.Status = statusDryRun
+	ev.report(ev.cfg.ExplainSubject)
+}
+
+// trace lists the steps deleting the event would take
+func (ev *Event) trace() []string {
+	var steps []string
+	add := func(format string, args ...interface{}) {
+		steps = append(steps, fmt.Sprintf(format, args...))
+	}
+
+	if err := ev.Validate(); err != nil {
+		add("validation: failed: %s", err.Error())
+		return steps
+	}
+	add("validation: passed")
+
+	cfg := ev.cfg
+	if cfg.Seen != nil && ev.UUID != "" && cfg.Seen.Seen(ev.UUID) {
+		add("dedup: event %s was already processed and would be skipped", ev.UUID)
+		return steps
+	}
+
+	if cfg.ObserveOnly {
+		add("observe only: enabled, no aws calls would be made")
+		return steps
+	}
+
+	if src := credentialEvent(ev); src != ev {
+		add("credentials: %s, configured for region %s", describeCredentials(src), ev.DatacenterRegion)
+	} else {
+		add("credentials: %s", describeCredentials(src))
+	}
+
+	if len(ev.SecurityGroupAWSIDs) > 0 {
+		add("batch: %d groups, %d at a time", len(ev.SecurityGroupAWSIDs), cfg.batchConcurrency())
+		for _, id := range ev.SecurityGroupAWSIDs {
+			ev.traceGroup(id, add)
+		}
+		return steps
+	}
+
+	id := ev.SecurityGroupAWSID
+	if ev.byName() {
+		add("call: DescribeSecurityGroups named %s, with %s for several matches", ev.SecurityGroupName, cfg.NameConflictPolicy)
+		id = "named " + ev.SecurityGroupName
+	} else if id == "" {
+		add("call: DescribeNetworkInterfaces %s to discover its group", ev.NetworkInterfaceID)
+		id = "attached to " + ev.NetworkInterfaceID
+	}
+
+	ev.traceGuards(id, add)
+
+	if cfg.CompareRules {
+		add("drift: compare the event's rules with security group %s", id)
+	}
+
+	if ev.revokeBeforeDelete() && !ev.hasRules() {
+		add("revoke: skipped, the event has no rules")
+	} else if ev.revokeBeforeDelete() {
+		ingress := len(chunk(permissions(ev.SecurityGroupRules.Ingress), cfg.RevokeChunkSize))
+		egress := len(chunk(permissions(ev.SecurityGroupRules.Egress), cfg.RevokeChunkSize))
+		add("call: RevokeSecurityGroupIngress x%d, RevokeSecurityGroupEgress x%d on %s", ingress, egress, id)
+	} else {
+		add("revoke: skipped")
+	}
+
+	ev.traceDelete(id, add)
+
+	return steps
+}
+
+// traceGroup lists the guards and calls deleting a single group takes
+func (ev *Event) traceGroup(id string, add func(string, ...interface{})) {
+	ev.traceGuards(id, add)
+	ev.traceDelete(id, add)
+}
+
+// traceGuards lists the checks made before a group is changed
+func (ev *Event) traceGuards(id string, add func(string, ...interface{})) {
+	if ev.cfg.VerifyVPC {
+		add("guard: security group %s must belong to %s", id, ev.VPCID)
+	}
+
+	if ev.cfg.ProtectionTag != "" {
+		add("guard: security group %s must not be tagged %s", id, ev.cfg.ProtectionTag)
+	}
+}
+
+// traceDelete lists the calls deleting a group takes
+func (ev *Event) traceDelete(id string, add func(string, ...interface{})) {
+	add("call: DeleteSecurityGroup %s", id)
+
+	if ev.cfg.ConfirmDelete {
+		add("confirm: poll DescribeSecurityGroups until %s is gone", id)
+	}
+}
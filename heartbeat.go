@@ -0,0 +1,67 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+var started = time.Now()
+
+// beat is the heartbeat message
+type beat struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	Received      int64 `json:"received"`
+	Completed     int64 `json:"completed"`
+	Failed        int64 `json:"failed"`
+}
+
+// heartbeat publishes one heartbeat message on subject
+func heartbeat(subject string) {
+	data, err := json.Marshal(beat{
+		UptimeSeconds: int64(time.Since(started) / time.Second),
+		Received:      eventsReceived.Value(),
+		Completed:     eventsCompleted.Value(),
+		Failed:        eventsFailed.Value(),
+	})
+	if err != nil {
+		log.Printf("Warning: could not encode heartbeat: %s", err.Error())
+		return
+	}
+
+	if err := conn().Publish(subject, data); err != nil {
+		log.Printf("Warning: could not publish heartbeat: %s", err.Error())
+	}
+}
+
+// startHeartbeat publishes heartbeats every HeartbeatInterval until the
+// returned func is called
+func startHeartbeat(cfg *Config) func() {
+	subject, interval := cfg.HeartbeatSubject, cfg.HeartbeatInterval
+	if subject == "" || interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				heartbeat(subject)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
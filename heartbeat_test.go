@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHeartbeat(t *testing.T) {
+	testSetup()
+
+	Convey("Given heartbeats are enabled", t, func() {
+		cfg := defaultConfig()
+		cfg.HeartbeatSubject = "test.heartbeat"
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+
+		beats := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("test.heartbeat", beats)
+
+		Convey("When the heartbeat is running", func() {
+			stop := startHeartbeat(cfg)
+			start := time.Now()
+
+			var received []*nats.Msg
+			for len(received) < 3 {
+				msg, timeout := waitMsg(beats)
+				So(timeout, ShouldBeNil)
+				received = append(received, msg)
+			}
+			elapsed := time.Since(start)
+			stop()
+
+			Convey("It should publish at the configured interval", func() {
+				So(elapsed, ShouldBeGreaterThanOrEqualTo, 150*time.Millisecond)
+				So(elapsed, ShouldBeLessThan, time.Second)
+			})
+
+			Convey("It should include uptime and processed counts", func() {
+				var b map[string]interface{}
+				So(json.Unmarshal(received[0].Data, &b), ShouldBeNil)
+				So(b, ShouldContainKey, "uptime_seconds")
+				So(b, ShouldContainKey, "received")
+				So(b, ShouldContainKey, "completed")
+				So(b, ShouldContainKey, "failed")
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+		})
+	})
+
+	Convey("Given heartbeats are disabled", t, func() {
+		cfg := defaultConfig()
+		beats := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("test.heartbeat", beats)
+
+		Convey("When starting the heartbeat", func() {
+			stop := startHeartbeat(cfg)
+			msg, _ := waitMsg(beats)
+			stop()
+
+			Convey("It should not publish anything", func() {
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+		})
+	})
+}
@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metrics is the running metrics server, shut down on exit
+var metrics struct {
+	sync.Mutex
+	server *http.Server
+}
+
+// writeMetrics writes every registered counter in the prometheus text format
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	registry.Lock()
+	lines := make([]string, 0, len(registry.counters))
+	for _, c := range registry.counters {
+		lines = append(lines, fmt.Sprintf("%s %d\n", c.name, c.Value()))
+	}
+	registry.Unlock()
+
+	sort.Strings(lines)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, l := range lines {
+		fmt.Fprint(w, l)
+	}
+}
+
+// healthz reports whether the nats connection is up
+func healthz(w http.ResponseWriter, r *http.Request) {
+	if c := conn(); c == nil || !c.IsConnected() {
+		http.Error(w, "nats disconnected", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveMetrics starts the metrics and health endpoint. A port that can't
+// be bound is only logged unless StrictListeners is set, so events keep
+// being processed without the endpoint.
+func serveMetrics(cfg *Config) (net.Listener, error) {
+	addr := cfg.MetricsAddr
+	if addr == "" {
+		return nil, nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		if cfg.StrictListeners {
+			return nil, fmt.Errorf("could not serve metrics on %s: %s", addr, err.Error())
+		}
+		log.Printf("Warning: could not serve metrics on %s, continuing without it: %s", addr, err.Error())
+		return nil, nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	mux.HandleFunc("/healthz", healthz)
+
+	srv := &http.Server{Handler: mux}
+	metrics.Lock()
+	metrics.server = srv
+	metrics.Unlock()
+
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("Warning: metrics endpoint stopped: %s", err.Error())
+		}
+	}()
+
+	return l, nil
+}
+
+// stopMetrics shuts the metrics endpoint down, waiting for requests in
+// flight until ctx is done
+func stopMetrics(ctx context.Context) error {
+	metrics.Lock()
+	srv := metrics.server
+	metrics.server = nil
+	metrics.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,129 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given a metrics endpoint", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.MetricsAddr = "127.0.0.1:0"
+
+		Convey("When the port is free", func() {
+			l, err := serveMetrics(cfg)
+			So(err, ShouldBeNil)
+			defer l.Close()
+
+			resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			health, err := http.Get("http://" + l.Addr().String() + "/healthz")
+			So(err, ShouldBeNil)
+			health.Body.Close()
+
+			Convey("It should serve the counters and health", func() {
+				So(string(body), ShouldContainSubstring, "firewall_delete_events_total ")
+				So(health.StatusCode, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When the port is already in use", func() {
+			taken, _ := net.Listen("tcp", "127.0.0.1:0")
+			defer taken.Close()
+			cfg.MetricsAddr = taken.Addr().String()
+
+			l, err := serveMetrics(cfg)
+
+			Convey("It should carry on without the endpoint", func() {
+				So(err, ShouldBeNil)
+				So(l, ShouldBeNil)
+			})
+
+			Convey("It should still process events", func() {
+				fake := &fakeEC2{}
+				restore := useFakeEC2(fake)
+				defer restore()
+
+				data, _ := json.Marshal(testEvent)
+				eventHandler(cfg, &nats.Msg{Data: data})
+
+				_, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+
+			Convey("It should fail in strict mode", func() {
+				cfg.StrictListeners = true
+				_, err := serveMetrics(cfg)
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Reset(func() {
+			stopMetrics(context.Background())
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestMetricsShutdown(t *testing.T) {
+	Convey("Given a running metrics endpoint", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.MetricsAddr = "127.0.0.1:0"
+		var codes []int
+		exit = func(code int) { codes = append(codes, code) }
+
+		l, err := serveMetrics(cfg)
+		So(err, ShouldBeNil)
+		addr := l.Addr().String()
+
+		Convey("When the connector shuts down", func() {
+			drainAndExit(cfg)
+
+			Convey("It should stop the endpoint and release its port before exiting", func() {
+				So(codes, ShouldResemble, []int{0})
+				_, err := http.Get("http://" + addr + "/healthz")
+				So(err, ShouldNotBeNil)
+
+				free, err := net.Listen("tcp", addr)
+				So(err, ShouldBeNil)
+				free.Close()
+			})
+		})
+
+		Convey("When the endpoint is already stopped", func() {
+			So(stopMetrics(context.Background()), ShouldBeNil)
+
+			Convey("It should not fail stopping it again", func() {
+				So(stopMetrics(context.Background()), ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			stopMetrics(context.Background())
+			exit = os.Exit
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
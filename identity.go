@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// stsClient is the subset of the STS api used by the connector
+type stsClient interface {
+	GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
+
+// newSTSClient builds the sts client used to identify the caller
+var newSTSClient = func(ev *Event) stsClient {
+	return sts.New(session.New(), awsConfig(ev))
+}
+
+type identity struct {
+	arn     string
+	account string
+}
+
+// identities caches caller identities by the credentials they were
+// looked up with
+var identities = struct {
+	sync.Mutex
+	byKey map[string]identity
+}{byKey: make(map[string]identity)}
+
+// callerIdentity returns the cached identity for the event's credentials
+func callerIdentity(ev *Event) (identity, error) {
+	key := credentialKey(ev)
+
+	identities.Lock()
+	id, ok := identities.byKey[key]
+	identities.Unlock()
+
+	if ok {
+		return id, nil
+	}
+
+	resp, err := newSTSClient(ev).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return id, err
+	}
+
+	if resp == nil {
+		return id, ErrEmptyResponse
+	}
+
+	id = identity{
+		arn:     aws.StringValue(resp.Arn),
+		account: aws.StringValue(resp.Account),
+	}
+
+	identities.Lock()
+	identities.byKey[key] = id
+	identities.Unlock()
+
+	return id, nil
+}
+
+// identify records who performed the deletion on the event
+func identify(ev *Event) {
+	id, err := callerIdentity(ev)
+	if err != nil {
+		log.Printf("Warning: could not get caller identity: %s", err.Error())
+		return
+	}
+
+	ev.PerformedByARN = id.arn
+	ev.AccountID = id.account
+}
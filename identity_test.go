@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeSTS struct {
+	calls int
+}
+
+func (f *fakeSTS) GetCallerIdentity(in *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	f.calls++
+	return &sts.GetCallerIdentityOutput{
+		Arn:     aws.String("arn:aws:iam::123456789012:user/ernest"),
+		Account: aws.String("123456789012"),
+	}, nil
+}
+
+func TestCallerIdentity(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given caller identity is enabled", t, func() {
+		cfg := defaultConfig()
+		cfg.IncludeCallerIdentity = true
+		identities.byKey = make(map[string]identity)
+
+		fake := &fakeSTS{}
+		original := newSTSClient
+		newSTSClient = func(ev *Event) stsClient {
+			return fake
+		}
+		restore := useFakeEC2(&fakeEC2{})
+
+		Convey("When events are handled", func() {
+			valid, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: valid})
+			eventHandler(cfg, &nats.Msg{Data: valid})
+
+			Convey("It should include the identity on the done event", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"performed_by_arn":"arn:aws:iam::123456789012:user/ernest"`)
+				So(string(msg.Data), ShouldContainSubstring, `"account_id":"123456789012"`)
+				waitMsg(completed)
+			})
+
+			Convey("It should only look up the identity once", func() {
+				So(fake.calls, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When events resolve to different profiles", func() {
+			ev1, ev2 := testEvent, testEvent
+			ev1.DatacenterAccessKey, ev2.DatacenterAccessKey = "", ""
+			ev1.DatacenterProfile, ev2.DatacenterProfile = "ernest", "other"
+			callerIdentity(&ev1)
+			callerIdentity(&ev2)
+
+			Convey("It should look up each identity", func() {
+				So(fake.calls, ShouldEqual, 2)
+			})
+		})
+
+		Reset(func() {
+			newSTSClient = original
+			restore()
+			for len(completed) > 0 {
+				<-completed
+			}
+		})
+	})
+}
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// lastEvent is when the last event arrived, in unix nanoseconds
+var lastEvent int64
+
+// touch records that an event arrived
+func touch() {
+	atomic.StoreInt64(&lastEvent, time.Now().UnixNano())
+}
+
+// idleFor returns how long it has been since the last event
+func idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastEvent)))
+}
+
+// watchIdle exits once no event has arrived for IdleTimeout, until the
+// returned func is called
+func watchIdle(cfg *Config) func() {
+	timeout := cfg.IdleTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	touch()
+	done := make(chan struct{})
+
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			idle := idleFor()
+			if idle >= timeout {
+				log.Printf("no events for %s, exiting", timeout)
+				drainAndExit(cfg)
+				return
+			}
+			timer.Reset(timeout - idle)
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
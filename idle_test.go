@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	Convey("Given an idle timeout", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.IdleTimeout = 50 * time.Millisecond
+
+		exited := make(chan int, 1)
+		exit = func(code int) { exited <- code }
+
+		Convey("When no event arrives", func() {
+			stop := watchIdle(cfg)
+			defer stop()
+
+			code := -1
+			select {
+			case code = <-exited:
+			case <-time.After(time.Second):
+			}
+
+			Convey("It should exit cleanly once the timeout expires", func() {
+				So(code, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When events keep arriving", func() {
+			stop := watchIdle(cfg)
+			for i := 0; i < 4; i++ {
+				time.Sleep(25 * time.Millisecond)
+				touch()
+			}
+			stop()
+
+			Convey("It should keep running", func() {
+				So(exited, ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			exit = os.Exit
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
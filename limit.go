@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/nats-io/nats"
+)
+
+var handled int64
+
+var subscription *nats.Subscription
+
+var exit = os.Exit
+
+// countHandled records a terminal result, exiting once MaxEvents is
+// reached. The drain runs apart from the event's worker, which it waits for.
+func countHandled(cfg *Config) {
+	n := atomic.AddInt64(&handled, 1)
+	if cfg.MaxEvents > 0 && n == int64(cfg.MaxEvents) {
+		log.Printf("handled %d events, exiting", cfg.MaxEvents)
+		go drainAndExit(cfg)
+	}
+}
+
+// drainAndExit stops taking events, waits for those already taken,
+// flushes published results, stops the http endpoints and exits
+func drainAndExit(cfg *Config) {
+	if subscription != nil {
+		if err := subscription.Unsubscribe(); err != nil {
+			log.Printf("Warning: could not unsubscribe: %s", err.Error())
+		}
+	}
+	events.wait(0)
+
+	if c := conn(); c != nil {
+		if err := c.Flush(); err != nil {
+			log.Printf("Warning: could not flush results: %s", err.Error())
+		}
+	}
+	flushMirror()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+	if err := stopMetrics(ctx); err != nil {
+		log.Printf("Warning: could not stop the metrics endpoint: %s", err.Error())
+	}
+
+	exit(0)
+}
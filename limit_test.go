@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMaxEvents(t *testing.T) {
+	testSetup()
+
+	Convey("Given a limit on the events to handle", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.MaxEvents = 3
+		atomic.StoreInt64(&handled, 0)
+
+		codes := make(chan int, 1)
+		exit = func(code int) { codes <- code }
+
+		exited := func() []int {
+			select {
+			case code := <-codes:
+				return []int{code}
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}
+
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		valid, _ := json.Marshal(testEvent)
+		invalidEvent := testEvent
+		invalidEvent.VPCID = ""
+		invalid, _ := json.Marshal(invalidEvent)
+
+		Convey("When fewer events have been handled", func() {
+			eventHandler(cfg, &nats.Msg{Data: valid})
+			eventHandler(cfg, &nats.Msg{Data: invalid})
+
+			Convey("It should keep running", func() {
+				So(exited(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the limit is reached", func() {
+			eventHandler(cfg, &nats.Msg{Data: valid})
+			eventHandler(cfg, &nats.Msg{Data: invalid})
+			eventHandler(cfg, &nats.Msg{Data: valid})
+
+			Convey("It should exit cleanly", func() {
+				So(exited(), ShouldResemble, []int{0})
+			})
+		})
+
+		Reset(func() {
+			exit = os.Exit
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,29 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// logWriter opens the destination logs are written to: stdout, stderr
+// or a file path, which is created if needed and appended to
+func logWriter(dest string) (io.Writer, error) {
+	switch dest {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open LOG_OUTPUT %s: %s", dest, err.Error())
+	}
+
+	return f, nil
+}
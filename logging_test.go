@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogOutput(t *testing.T) {
+	Convey("Given a log output", t, func() {
+		Convey("When it is stdout or stderr", func() {
+			out, oerr := logWriter("stdout")
+			errOut, eerr := logWriter("stderr")
+
+			Convey("It should use the standard streams", func() {
+				So(oerr, ShouldBeNil)
+				So(eerr, ShouldBeNil)
+				So(out, ShouldEqual, os.Stdout)
+				So(errOut, ShouldEqual, os.Stderr)
+			})
+		})
+
+		Convey("When it is a file path", func() {
+			dir, _ := ioutil.TempDir("", "logs")
+			path := filepath.Join(dir, "connector.log")
+			ioutil.WriteFile(path, []byte("existing\n"), 0644)
+
+			w, err := logWriter(path)
+			So(err, ShouldBeNil)
+			log.SetOutput(w)
+			log.Println("security group deleted")
+			log.SetOutput(os.Stdout)
+			w.(*os.File).Close()
+
+			Convey("It should append the logs to the file", func() {
+				data, _ := ioutil.ReadFile(path)
+				So(string(data), ShouldStartWith, "existing\n")
+				So(string(data), ShouldContainSubstring, "security group deleted")
+			})
+
+			Reset(func() {
+				os.RemoveAll(dir)
+			})
+		})
+
+		Convey("When the file cannot be created", func() {
+			_, err := logWriter(filepath.Join(os.TempDir(), "missing", "dir", "connector.log"))
+
+			Convey("It should error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "LOG_OUTPUT")
+			})
+		})
+	})
+}
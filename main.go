@@ -5,67 +5,480 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand"
+	"net/url"
 	"os"
 	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	ecc "github.com/ernestio/ernest-config-client"
 	"github.com/nats-io/nats"
 )
 
-var nc *nats.Conn
+// nc is the nats connection, replaced when a closed connection is
+// re-established, so it is only used through conn and setConn
+var (
+	ncMu sync.RWMutex
+	nc   *nats.Conn
+)
 var natsErr error
 
-func eventHandler(m *nats.Msg) {
-	var f Event
+// conn returns the current nats connection
+func conn() *nats.Conn {
+	ncMu.RLock()
+	defer ncMu.RUnlock()
+
+	return nc
+}
+
+// setConn replaces the nats connection
+func setConn(c *nats.Conn) {
+	ncMu.Lock()
+	defer ncMu.Unlock()
+
+	nc = c
+}
+
+var (
+	ErrNatsURIMissing = errors.New("NATS_URI is not set, it should point to a nats server e.g. nats://127.0.0.1:4222")
+)
+
+// validateNatsURI checks the nats connection string before connecting
+func validateNatsURI(uri string) error {
+	if uri == "" {
+		return ErrNatsURIMissing
+	}
+
+	for _, server := range strings.Split(uri, ",") {
+		u, err := url.Parse(strings.TrimSpace(server))
+		if err != nil || u.Host == "" || (u.Scheme != "nats" && u.Scheme != "tls") {
+			return fmt.Errorf("NATS_URI %q is malformed, expected a nats://host:port url", server)
+		}
+	}
+
+	return nil
+}
+
+// eventHandler processes a delete event with the given settings
+func eventHandler(cfg *Config, m *nats.Msg) {
+	defer exitOnPanic()
+
+	f := Event{cfg: cfg, reply: m.Reply}
+
+	eventsReceived.Inc()
+	touch()
+	defer countHandled(cfg)
+
+	if oversized(cfg, m.Data) {
+		eventsFailed.Inc()
+		rejectOversized(cfg, m.Subject, m.Reply, m.Data)
+		return
+	}
 
 	err := f.Process(m.Data)
 	if err != nil {
+		eventsFailed.Inc()
 		return
 	}
 
-	if err = f.Validate(); err != nil {
+	if !f.Explain && cfg.Seen != nil && f.UUID != "" && cfg.Seen.Seen(f.UUID) {
+		log.Printf("event %s was already processed, skipping", f.UUID)
+		f.skipDuplicate()
+		return
+	}
+
+	if f.PlanID != "" {
+		if err = f.confirm(); err != nil {
+			eventsFailed.Inc()
+			f.Invalid(err)
+			return
+		}
+	}
+
+	if err = applySecretFiles(&f); err != nil {
+		eventsFailed.Inc()
 		f.Error(err)
 		return
 	}
+	f.applyDefaults()
 
-	err = deleteFirewall(&f)
+	if f.Explain {
+		explain(&f)
+		return
+	}
+
+	if err = f.Validate(); err != nil {
+		eventsFailed.Inc()
+		f.Invalid(err)
+		return
+	}
+
+	if cfg.ObserveOnly {
+		observe(&f)
+		return
+	}
+
+	if f.needsPlan() {
+		propose(&f)
+		return
+	}
+
+	res, err := deleteFirewall(&f)
+	f.apply(res)
 	if err != nil {
+		eventsFailed.Inc()
+		if isUnauthorized(err) {
+			unauthorized.Inc()
+		}
 		f.Error(err)
 		return
 	}
 
+	if cfg.IncludeCallerIdentity {
+		identify(&f)
+	}
+
+	if res.Status == statusAlreadyAbsent {
+		eventsNoop.Inc()
+	} else {
+		eventsCompleted.Inc()
+	}
+	if cfg.Seen != nil && f.UUID != "" {
+		cfg.Seen.Mark(f.UUID)
+	}
 	f.Complete()
 }
 
-func deleteFirewall(ev *Event) error {
-	creds := credentials.NewStaticCredentials(ev.DatacenterAccessKey, ev.DatacenterAccessToken, "")
-	svc := ec2.New(session.New(), &aws.Config{
-		Region:      aws.String(ev.DatacenterRegion),
-		Credentials: creds,
-	})
+// observe reports what would be deleted without calling aws
+func observe(ev *Event) {
+	log.Printf("observe only: would delete security group %s", ev.target())
+	ev.Status = statusObserved
+	ev.report(ev.cfg.ObserveSubject)
+}
+
+// eventContext bounds the processing of an event by EventTimeout
+func eventContext(cfg *Config) (context.Context, context.CancelFunc) {
+	if cfg.EventTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cfg.EventTimeout)
+}
+
+func deleteFirewall(ev *Event) (*DeleteResult, error) {
+	ctx, cancel := eventContext(ev.cfg)
+	defer cancel()
+
+	d := &deletion{
+		ctx:    ctx,
+		ev:     ev,
+		result: &DeleteResult{ClientRequestToken: newClientToken()},
+	}
+	start := time.Now()
+
+	err := d.run()
+
+	d.result.Duration = time.Since(start)
+	d.result.Status = statusOf(d.result, err)
+
+	return d.result, err
+}
+
+// run deletes the group or groups the event targets
+func (d *deletion) run() error {
+	ev, cfg := d.ev, d.ev.cfg
+
+	if cfg.SerializeVPC && ev.VPCID != "" {
+		defer vpcLocks.lock(ev.VPCID)()
+	}
+
+	release := acquireClient(ev.highPriority())
+	defer release()
+
+	if err := assumeRole(d.ctx, ev); err != nil {
+		return err
+	}
+
+	d.svc = newEC2Client(ev)
+
+	if ev.byName() {
+		ids, err := d.groupsNamed(ev.SecurityGroupName)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 1 {
+			ev.SecurityGroupAWSID = ids[0]
+		} else {
+			ev.SecurityGroupAWSIDs = ids
+		}
+	}
+
+	if len(ev.SecurityGroupAWSIDs) > 0 {
+		return d.deleteBatch()
+	}
+
+	if ev.SecurityGroupAWSID == "" {
+		id, err := d.discoverGroup()
+		if err != nil {
+			return err
+		}
+		ev.SecurityGroupAWSID = id
+	}
+
+	if err := d.checkGroup(ev.SecurityGroupAWSID); err != nil {
+		return err
+	}
+
+	if cfg.CompareRules {
+		d.compareRules(ev.SecurityGroupAWSID)
+	}
+
+	if ev.revokeBeforeDelete() && !ev.hasRules() {
+		log.Printf("security group %s has no rules on the event, skipping revoke", ev.SecurityGroupAWSID)
+	} else if ev.revokeBeforeDelete() {
+		if err := d.revokeRules(); err != nil {
+			if cfg.RevokeStrict {
+				return err
+			}
+			log.Printf("Warning: %s, deleting the security group anyway", err.Error())
+		}
+	}
+
+	err := d.deleteGroup(ev.SecurityGroupAWSID)
+	if err != nil {
+		d.diagnose(ev.SecurityGroupAWSID, err)
+	}
+
+	return err
+}
+
+// deleteGroup deletes a single security group. Events are delivered at
+// least once, so another replica may already have deleted the group; a
+// group that no longer exists is recorded as already deleted rather
+// than failing, as is one still being deleted once it has gone.
+func (d *deletion) deleteGroup(id string) error {
+	if err := d.checkGroup(id); err != nil {
+		return err
+	}
 
 	req := ec2.DeleteSecurityGroupInput{
-		GroupId: aws.String(ev.SecurityGroupAWSID),
+		GroupId: aws.String(id),
 	}
 
-	_, err := svc.DeleteSecurityGroup(&req)
+	var resp *ec2.DeleteSecurityGroupOutput
+	del := func() error {
+		return d.call("DeleteSecurityGroup", func(ctx aws.Context) (err error) {
+			resp, err = d.svc.DeleteSecurityGroupWithContext(ctx, &req, withClientToken(d.result.ClientRequestToken))
+			return err
+		})
+	}
+
+	err := del()
+	for attempt := 1; isDependencyViolation(err) && attempt < d.ev.cfg.DependencyAttempts; attempt++ {
+		delay := d.ev.cfg.DependencyDelay << uint(attempt-1)
+		log.Printf("security group %s is still in use, retrying in %s", id, delay)
+		d.mu.Lock()
+		d.result.Retries++
+		d.mu.Unlock()
+		if err = pause(d.ctx, delay); err != nil {
+			return err
+		}
+		err = del()
+	}
+	if isAbsent(id, err) {
+		log.Printf("security group %s was already deleted", id)
+		d.alreadyDeleted(id)
+		return nil
+	}
+	if isDeleting(err) {
+		log.Printf("security group %s is already being deleted, waiting for it to disappear", id)
+		if err := d.confirmDeleted(id); err != nil {
+			return err
+		}
+		d.alreadyDeleted(id)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
+	if resp == nil {
+		return ErrEmptyResponse
+	}
+
+	if d.ev.cfg.ConfirmDelete {
+		if err := d.confirmDeleted(id); err != nil {
+			return err
+		}
+	}
+
+	describeCache.forget(cacheKey(d.ev.DatacenterRegion, id))
+
+	d.mu.Lock()
+	d.result.DeletedIDs = append(d.result.DeletedIDs, id)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// checkGroup runs the checks refusing to touch a group, so they can be
+// made before anything changes it
+func (d *deletion) checkGroup(id string) error {
+	if err := d.checkVPC(id); err != nil {
+		return err
+	}
+	return d.checkProtection(id)
+}
+
+// alreadyDeleted records a group some other request deleted
+func (d *deletion) alreadyDeleted(id string) {
+	describeCache.forget(cacheKey(d.ev.DatacenterRegion, id))
+	d.mu.Lock()
+	d.result.AlreadyDeleted = append(d.result.AlreadyDeleted, id)
+	d.mu.Unlock()
+}
+
+// connect opens the nats connection described by the config
+func connect(cfg *Config) (*nats.Conn, error) {
+	if usesTLS(cfg.NatsURI) {
+		return connectSecure(cfg.NatsURI, cfg.TLSMinVersion)
+	}
+	return connectPlain(cfg.NatsURI)
+}
+
+// connectPlain connects through the config client, reporting its
+// connection panics as errors
+func connectPlain(uri string) (c *nats.Conn, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not connect to nats: %v", r)
+		}
+	}()
+
+	return ecc.NewConfig(uri).Nats(), nil
+}
+
+// listen connects to nats and subscribes the connector's handlers
+func listen(cfg *Config) (*nats.Conn, error) {
+	c, err := connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.SetReconnectHandler(reconnected)
+
+	handler := func(m *nats.Msg) {
+		events.run(prioritized(m.Data), func() {
+			eventHandler(cfg, m)
+		})
+	}
+	if subscription, err = c.Subscribe(deleteSubject(cfg), handler); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if _, err = subscribeDescribe(cfg, c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if _, err = subscribeRetry(cfg, c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// exit codes, telling supervisors why the connector stopped
+const (
+	// exitConfig is a configuration the connector can't start with,
+	// which restarting won't fix
+	exitConfig = 78
+	// exitNATS is a nats connection that could not be established,
+	// which may succeed on restart
+	exitNATS = 69
+	// exitPanic is an unexpected failure while running
+	exitPanic = 70
+)
+
+// startup configures the connector and subscribes its handlers,
+// returning its settings. It exits with the code of the failure's class
+// when it can't, returning nil.
+func startup(getenv func(string) string) *Config {
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		return failStartup(exitConfig, err)
+	}
+
+	out, err := logWriter(cfg.LogOutput)
+	if err != nil {
+		return failStartup(exitConfig, err)
+	}
+	log.SetOutput(out)
+
+	setMaxClients(cfg.MaxAWSClients)
+	events = newWorkerPool(cfg.Workers)
+	rand.Seed(time.Now().UnixNano())
+
+	if pending, err = openSpool(cfg.ResultSpool, cfg.PendingResultsLimit); err != nil {
+		return failStartup(exitConfig, err)
+	}
+
+	if _, err = serveMetrics(cfg); err != nil {
+		return failStartup(exitConfig, err)
+	}
+
+	fmt.Println("listening for " + deleteSubject(cfg))
+	c, err := listen(cfg)
+	if err != nil {
+		return failStartup(exitNATS, err)
+	}
+	setConn(c)
+	redial = func() (*nats.Conn, error) {
+		return listen(cfg)
+	}
+	pending.flush(c)
+
+	if cfg.MirrorNatsURI != "" {
+		dialMirror(cfg)
+	}
+
+	return cfg
+}
+
+// failStartup logs why the connector can't start and exits with code
+func failStartup(code int, err error) *Config {
+	log.Printf("Error: %s", err.Error())
+	exit(code)
 	return nil
 }
 
+// exitOnPanic exits with exitPanic when the calling goroutine panics
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		log.Printf("Error: panic: %v\n%s", r, debug.Stack())
+		exit(exitPanic)
+	}
+}
+
 func main() {
-	nc = ecc.NewConfig(os.Getenv("NATS_URI")).Nats()
+	defer exitOnPanic()
+
+	cfg := startup(os.Getenv)
+	if cfg == nil {
+		return
+	}
 
-	fmt.Println("listening for firewall.delete.aws")
-	nc.Subscribe("firewall.delete.aws", eventHandler)
+	startHeartbeat(cfg)
+	watchIdle(cfg)
 
 	runtime.Goexit()
 }
@@ -0,0 +1,865 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStartup(t *testing.T) {
+	Convey("Given a nats uri", t, func() {
+		Convey("When it is empty", func() {
+			err := validateNatsURI("")
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrNatsURIMissing)
+			})
+		})
+
+		Convey("When it is malformed", func() {
+			err := validateNatsURI("127.0.0.1:4222")
+			Convey("It should error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "malformed")
+			})
+		})
+
+		Convey("When it lists valid servers", func() {
+			err := validateNatsURI("nats://127.0.0.1:4222, nats://127.0.0.2:4222")
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestExitCodes(t *testing.T) {
+	Convey("Given the connector starting up", t, func() {
+		log.SetOutput(ioutil.Discard)
+		live := conn()
+		var codes []int
+		exit = func(code int) { codes = append(codes, code) }
+
+		Convey("When the config is invalid", func() {
+			cfg := startup(testEnv(map[string]string{"NATS_URI": "127.0.0.1:4222"}))
+
+			Convey("It should exit with the config code", func() {
+				So(cfg, ShouldBeNil)
+				So(codes, ShouldResemble, []int{exitConfig})
+			})
+		})
+
+		Convey("When a result subject is one the connector consumes", func() {
+			cfg := startup(testEnv(map[string]string{
+				"NATS_URI":       testNatsURI(),
+				"SUBJECT_PREFIX": "test.firewall",
+				"AUDIT_SUBJECT":  "test.firewall.delete.aws",
+			}))
+
+			Convey("It should refuse to start with the config code", func() {
+				So(cfg, ShouldBeNil)
+				So(codes, ShouldResemble, []int{exitConfig})
+			})
+		})
+
+		Convey("When nats can't be reached", func() {
+			cfg := startup(testEnv(map[string]string{"NATS_URI": "tls://127.0.0.1:1"}))
+
+			Convey("It should exit with the nats code", func() {
+				So(cfg, ShouldBeNil)
+				So(codes, ShouldResemble, []int{exitNATS})
+			})
+		})
+
+		Convey("When everything is in place", func() {
+			cfg := startup(testEnv(map[string]string{"NATS_URI": testNatsURI()}))
+
+			Convey("It should carry on without exiting", func() {
+				So(cfg, ShouldNotBeNil)
+				So(codes, ShouldBeEmpty)
+				conn().Close()
+			})
+		})
+
+		Convey("When a handler panics", func() {
+			func() {
+				defer exitOnPanic()
+				panic("boom")
+			}()
+
+			Convey("It should exit with the panic code", func() {
+				So(codes, ShouldResemble, []int{exitPanic})
+			})
+		})
+
+		Reset(func() {
+			setConn(live)
+			redial = nil
+			exit = os.Exit
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestErrorRouting(t *testing.T) {
+	testSetup()
+
+	Convey("Given separate error subjects", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ErrorSubject = "test.error"
+		cfg.ValidationErrorSubject = "test.validation"
+
+		errored := make(chan *nats.Msg, 10)
+		invalidated := make(chan *nats.Msg, 10)
+		s1, _ := conn().ChanSubscribe("test.error", errored)
+		s2, _ := conn().ChanSubscribe("test.validation", invalidated)
+
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When an event fails validation", func() {
+			ev := testEvent
+			ev.VPCID = ""
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish to the validation error subject", func() {
+				msg, timeout := waitMsg(invalidated)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, "Datacenter VPC ID invalid")
+				So(string(msg.Data), ShouldContainSubstring, `"status":"failed"`)
+				msg, _ = waitMsg(errored)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When an event fails to delete", func() {
+			fake.deleteErr = errors.New("boom")
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish to the error subject", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, "boom")
+				msg, _ = waitMsg(invalidated)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			s1.Unsubscribe()
+			s2.Unsubscribe()
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestErrorCategories(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given events failing in different ways", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		category := func() string {
+			msg, timeout := waitMsg(errored)
+			So(timeout, ShouldBeNil)
+			var res struct {
+				Status   string `json:"status"`
+				Category string `json:"error_category"`
+			}
+			So(json.Unmarshal(msg.Data, &res), ShouldBeNil)
+			So(res.Status, ShouldEqual, statusFailed)
+			return res.Category
+		}
+
+		Convey("When an event cannot be parsed", func() {
+			eventHandler(cfg, &nats.Msg{Data: []byte(`{"vpc_id":1}`)})
+
+			Convey("It should be a transport error", func() {
+				So(category(), ShouldEqual, "transport")
+			})
+		})
+
+		Convey("When an event fails validation", func() {
+			ev := testEvent
+			ev.VPCID = ""
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should be a validation error", func() {
+				So(category(), ShouldEqual, "validation")
+			})
+		})
+
+		Convey("When aws rejects the deletion", func() {
+			fake.deleteErr = awserr.New("DependencyViolation", "resource sg-0000000 has a dependent object", nil)
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should be an aws error", func() {
+				So(category(), ShouldEqual, "aws")
+			})
+		})
+
+		Convey("When a check refuses the deletion", func() {
+			fake.groups = []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-1111111")}}
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should be a validation error", func() {
+				So(category(), ShouldEqual, "validation")
+			})
+		})
+
+		Reset(func() {
+			restore()
+			newTimer = time.NewTimer
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestObserveOnly(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given observe only mode", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ObserveOnly = true
+		cfg.AuditSubject = "firewall.delete.aws.audit"
+		observed := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe(cfg.ObserveSubject, observed)
+		audited := make(chan *nats.Msg, 10)
+		auditSub, _ := conn().ChanSubscribe(cfg.AuditSubject, audited)
+		invoked := false
+		original := newEC2Client
+		newEC2Client = func(ev *Event) ec2Client {
+			invoked = true
+			return &fakeEC2{}
+		}
+
+		Convey("When handling a valid event", func() {
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish an observed result without creating an aws client", func() {
+				msg, timeout := waitMsg(observed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"observed"`)
+				So(invoked, ShouldBeFalse)
+			})
+
+			Convey("It should not report the event as completed", func() {
+				msg, _ := waitMsg(completed)
+				So(msg, ShouldBeNil)
+				msg, _ = waitMsg(audited)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			auditSub.Unsubscribe()
+			newEC2Client = original
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestOversizedEvents(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given a limit on incoming payloads", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.MaxPayloadBytes = 64
+		deadletters := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("firewall.delete.aws.deadletter", deadletters)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When an event exceeds the limit", func() {
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Subject: "firewall.delete.aws", Data: data})
+
+			Convey("It should dead letter it with the reason without processing it", func() {
+				msg, timeout := waitMsg(deadletters)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"failed"`)
+				So(string(msg.Data), ShouldContainSubstring, `"error":"Event payload is too large"`)
+				So(string(msg.Data), ShouldContainSubstring, `"limit":64`)
+				So(string(msg.Data), ShouldNotContainSubstring, "sg-0000000")
+				So(fake.deleted, ShouldBeEmpty)
+				msg, _ = waitMsg(errored)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When the limit is disabled", func() {
+			cfg.MaxPayloadBytes = 0
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Subject: "firewall.delete.aws", Data: data})
+
+			Convey("It should process the event", func() {
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+				msg, _ := waitMsg(deadletters)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestMalformedEvents(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given a truncated event", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		deadletters := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("firewall.delete.aws.deadletter", deadletters)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		data, _ := json.Marshal(testEvent)
+		data = data[:len(data)/2]
+
+		Convey("When it is handled", func() {
+			eventHandler(cfg, &nats.Msg{Subject: "firewall.delete.aws", Data: data})
+
+			Convey("It should dead letter it as malformed with its size", func() {
+				msg, timeout := waitMsg(deadletters)
+				So(timeout, ShouldBeNil)
+
+				var letter deadLetter
+				So(json.Unmarshal(msg.Data, &letter), ShouldBeNil)
+				So(letter.Subject, ShouldEqual, "firewall.delete.aws")
+				So(letter.Size, ShouldEqual, len(data))
+				So(letter.ErrorCode, ShouldEqual, "malformed")
+				So(letter.ErrorCategory, ShouldEqual, "transport")
+				So(letter.Reason, ShouldEqual, "unexpected end of JSON input")
+				So(fake.deleted, ShouldBeEmpty)
+			})
+
+			Convey("It should not report it on the error subject", func() {
+				msg, _ := waitMsg(errored)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestExplain(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given an event asking for an explanation", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ProtectionTag = "ernest:protected=true"
+		cfg.AuditSubject = "firewall.delete.aws.audit"
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+		explained := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe(cfg.ExplainSubject, explained)
+		audited := make(chan *nats.Msg, 10)
+		auditSub, _ := conn().ChanSubscribe(cfg.AuditSubject, audited)
+
+		ev := testEvent
+		ev.cfg = cfg
+		ev.Explain = true
+		buildTestRules(&ev)
+		revoke := true
+		ev.Revoke = &revoke
+
+		Convey("When handling a valid event", func() {
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish the decision trace without calling aws", func() {
+				msg, timeout := waitMsg(explained)
+				So(timeout, ShouldBeNil)
+
+				var res Event
+				So(json.Unmarshal(msg.Data, &res), ShouldBeNil)
+				So(res.Status, ShouldEqual, "dry_run")
+				So(res.Trace, ShouldResemble, []string{
+					"validation: passed",
+					"credentials: static credentials ****",
+					"guard: security group sg-0000000 must belong to vpc-0000000",
+					"guard: security group sg-0000000 must not be tagged ernest:protected=true",
+					"call: RevokeSecurityGroupIngress x1, RevokeSecurityGroupEgress x1 on sg-0000000",
+					"call: DeleteSecurityGroup sg-0000000",
+				})
+				So(fake.deleted, ShouldBeEmpty)
+				So(fake.revokeCalls, ShouldEqual, 0)
+				So(fake.describeCalls, ShouldEqual, 0)
+			})
+
+			Convey("It should not report the event as completed", func() {
+				msg, _ := waitMsg(completed)
+				So(msg, ShouldBeNil)
+				msg, _ = waitMsg(audited)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When handling an invalid event", func() {
+			ev.VPCID = ""
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should trace the validation failure", func() {
+				msg, timeout := waitMsg(explained)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"trace":["validation: failed: Datacenter VPC ID invalid"]`)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			auditSub.Unsubscribe()
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestReplies(t *testing.T) {
+	testSetup()
+
+	Convey("Given an event sent as a request", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		replies := make(chan *nats.Msg, 10)
+		inbox := nats.NewInbox()
+		sub, _ := conn().ChanSubscribe(inbox, replies)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When it fails validation", func() {
+			ev := testEvent
+			ev.VPCID = ""
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data, Reply: inbox})
+
+			Convey("It should reply with the error", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"error":"Datacenter VPC ID invalid"`)
+			})
+		})
+
+		Convey("When it fails to delete", func() {
+			fake.deleteErr = errors.New("boom")
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data, Reply: inbox})
+
+			Convey("It should reply with the error", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"error":"boom"`)
+			})
+		})
+
+		Convey("When it cannot be parsed", func() {
+			eventHandler(cfg, &nats.Msg{Data: []byte(`{"vpc_id":1}`), Reply: inbox})
+
+			Convey("It should reply with the original message", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"payload":"{\"vpc_id\":1}"`)
+			})
+		})
+
+		Convey("When it is truncated", func() {
+			eventHandler(cfg, &nats.Msg{Data: []byte("{"), Reply: inbox})
+
+			Convey("It should reply with the size of the malformed message", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"size":1`)
+				So(string(msg.Data), ShouldContainSubstring, `"error_code":"malformed"`)
+			})
+		})
+
+		Convey("When it succeeds", func() {
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data, Reply: inbox})
+
+			Convey("It should reply with the result", func() {
+				msg, timeout := waitMsg(replies)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"deleted"`)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+// racingEC2 reports groups deleted by an earlier call as not found, the
+// way aws does when another replica won the race
+type racingEC2 struct {
+	fakeEC2
+}
+
+func (f *racingEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	for _, id := range f.deleted {
+		if id == aws.StringValue(in.GroupId) {
+			return nil, awserr.New("InvalidGroup.NotFound", "The security group does not exist", nil)
+		}
+	}
+	f.deleted = append(f.deleted, aws.StringValue(in.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+// blockedEC2 refuses to delete a group while it is still in use for the
+// first few attempts
+type blockedEC2 struct {
+	fakeEC2
+	blocked int
+}
+
+func (f *blockedEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.blocked > 0 {
+		f.blocked--
+		return nil, awserr.New("DependencyViolation", "resource sg-0000000 has a dependent object", nil)
+	}
+	f.deleted = append(f.deleted, aws.StringValue(in.GroupId))
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func TestDependencyRetries(t *testing.T) {
+	Convey("Given a group still in use by a detaching interface", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		var delays []time.Duration
+		newTimer = func(d time.Duration) *time.Timer {
+			delays = append(delays, d)
+			return time.NewTimer(0)
+		}
+		ev := testEvent
+		ev.cfg = cfg
+
+		Convey("When it is released before the attempts run out", func() {
+			fake := &blockedEC2{blocked: 3}
+			restore := useFakeEC2(fake)
+			defer restore()
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should delete the group after backing off", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+				So(delays, ShouldResemble, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second})
+				So(res.Retries, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When it is never released", func() {
+			fake := &blockedEC2{blocked: 10}
+			restore := useFakeEC2(fake)
+			defer restore()
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should give up with the last error", func() {
+				So(errorCode(err), ShouldEqual, "DependencyViolation")
+				So(fake.deleted, ShouldBeEmpty)
+				So(fake.blocked, ShouldEqual, 5)
+				So(delays, ShouldResemble, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second})
+			})
+		})
+
+		Convey("When the event runs out of time while backing off", func() {
+			cfg.EventTimeout = 20 * time.Millisecond
+			newTimer = func(time.Duration) *time.Timer { return time.NewTimer(time.Hour) }
+			fake := &blockedEC2{blocked: 10}
+			restore := useFakeEC2(fake)
+			defer restore()
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should stop retrying", func() {
+				So(err, ShouldEqual, context.DeadlineExceeded)
+				So(res.Status, ShouldEqual, statusCancelled)
+				So(fake.blocked, ShouldEqual, 9)
+			})
+		})
+
+		Convey("When dependency retries are turned off", func() {
+			cfg.DependencyAttempts = 1
+			fake := &blockedEC2{blocked: 1}
+			restore := useFakeEC2(fake)
+			defer restore()
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should fail on the first attempt", func() {
+				So(errorCode(err), ShouldEqual, "DependencyViolation")
+				So(delays, ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			newTimer = time.NewTimer
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestMalformedGroupIDs(t *testing.T) {
+	completed, errored := testSetup()
+
+	Convey("Given aws reports the group id as malformed", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.VerifyVPC = false
+		fake := &fakeEC2{deleteErr: awserr.New("InvalidGroupId.Malformed", "Invalid id", nil)}
+		restore := useFakeEC2(fake)
+
+		Convey("When the id was cleared by an earlier delivery", func() {
+			ev := testEvent
+			ev.SecurityGroupAWSID = " "
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should complete as already absent", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"already_absent"`)
+			})
+		})
+
+		Convey("When the id is set", func() {
+			ev := testEvent
+			ev.SecurityGroupAWSID = "sg-bad"
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should report the error", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"error_code":"InvalidGroupId.Malformed"`)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestRedelivery(t *testing.T) {
+	completed, errored := testSetup()
+
+	Convey("Given the same event delivered twice", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		fake := &racingEC2{}
+		restore := useFakeEC2(fake)
+		data, _ := json.Marshal(testEvent)
+
+		succeeded := eventsCompleted.Value()
+		noop := eventsNoop.Value()
+		failed := eventsFailed.Value()
+
+		Convey("When both deliveries are handled concurrently", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					eventHandler(cfg, &nats.Msg{Data: data})
+				}()
+			}
+			wg.Wait()
+
+			Convey("It should complete both without error", func() {
+				first, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				second, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(first.Data)+string(second.Data), ShouldContainSubstring, `"status":"deleted"`)
+				So(string(first.Data)+string(second.Data), ShouldContainSubstring, `"status":"already_absent"`)
+
+				msg, _ := waitMsg(errored)
+				So(msg, ShouldBeNil)
+			})
+
+			Convey("It should count the deletion only once", func() {
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+				So(eventsCompleted.Value()-succeeded, ShouldEqual, 1)
+				So(eventsNoop.Value()-noop, ShouldEqual, 1)
+				So(eventsFailed.Value()-failed, ShouldEqual, 0)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestMissingID(t *testing.T) {
+	completed, errored := testSetup()
+
+	Convey("Given an event without a security group id", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		ev := testEvent
+		ev.SecurityGroupAWSID = ""
+		data, _ := json.Marshal(ev)
+
+		Convey("When it is handled", func() {
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should report the missing id on the error event", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"security_group_aws_id":""`)
+				So(string(msg.Data), ShouldContainSubstring, `"error":"Security Group aws id missing`)
+			})
+		})
+
+		Convey("When it completes as a batch", func() {
+			ev.cfg = cfg
+			ev.SecurityGroupAWSIDs = []string{"sg-0000001", "sg-0000002"}
+			ev.Status = statusDeleted
+			ev.Complete()
+
+			Convey("It should leave the id out of the done event", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldNotContainSubstring, `"security_group_aws_id"`)
+			})
+		})
+
+		Reset(func() {
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given aws refuses the delete for lack of permissions", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		fake := &fakeEC2{deleteErr: awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)}
+		restore := useFakeEC2(fake)
+		count := unauthorized.Value()
+
+		Convey("When the event is handled", func() {
+			data, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should fail without retrying and report it as unauthorized", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"error_code":"unauthorized"`)
+				So(string(msg.Data), ShouldNotContainSubstring, `"retries"`)
+				So(unauthorized.Value()-count, ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestResultMetadata(t *testing.T) {
+	completed, errored := testSetup()
+
+	Convey("Given configured result metadata", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ResultMetadata = map[string]string{"environment": "prod", "service": "firewall-deleter"}
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+		data, _ := json.Marshal(testEvent)
+
+		Convey("When an event completes", func() {
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should add the metadata to the done event", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"metadata":{"environment":"prod","service":"firewall-deleter"}`)
+			})
+		})
+
+		Convey("When an event fails", func() {
+			fake.deleteErr = errors.New("boom")
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should add the metadata to the error event", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"metadata":{"environment":"prod","service":"firewall-deleter"}`)
+			})
+		})
+
+		Convey("When the event carries its own metadata", func() {
+			ev := testEvent
+			ev.Metadata = map[string]string{"environment": "staging"}
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should keep the event's values", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"metadata":{"environment":"staging","service":"firewall-deleter"}`)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
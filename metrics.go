@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	eventsReceived  = newCounter("firewall_delete_events_total")
+	eventsCompleted = newCounter("firewall_delete_success_total")
+	eventsFailed    = newCounter("firewall_delete_failure_total")
+	eventsNoop      = newCounter("firewall_delete_already_deleted_total")
+	unauthorized    = newCounter("firewall_delete_unauthorized_total")
+
+	firstTrySuccess = newCounter("firewall_delete_first_try_success_total")
+	retrySuccess    = newCounter("firewall_delete_retry_success_total")
+	retryExhausted  = newCounter("firewall_delete_retry_exhausted_total")
+)
+
+var registry = struct {
+	sync.Mutex
+	counters []*counter
+}{}
+
+// counter is a monotonically increasing value safe for concurrent use
+type counter struct {
+	name  string
+	value int64
+}
+
+// newCounter creates and registers a counter
+func newCounter(name string) *counter {
+	c := &counter{name: name}
+
+	registry.Lock()
+	registry.counters = append(registry.counters, c)
+	registry.Unlock()
+
+	return c
+}
+
+// counterFor returns the registered counter with the given name,
+// creating it on first use
+func counterFor(name string) *counter {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, c := range registry.counters {
+		if c.name == name {
+			return c
+		}
+	}
+
+	c := &counter{name: name}
+	registry.counters = append(registry.counters, c)
+
+	return c
+}
+
+// Inc increments the counter by one
+func (c *counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+// Add increments the counter by n
+func (c *counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+// Value returns the current count
+func (c *counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConcurrentCounters(t *testing.T) {
+	testSetup()
+
+	Convey("Given many concurrent events", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		valid, _ := json.Marshal(testEvent)
+		invalidEvent := testEvent
+		invalidEvent.VPCID = ""
+		invalid, _ := json.Marshal(invalidEvent)
+
+		received := eventsReceived.Value()
+		completed := eventsCompleted.Value()
+		failed := eventsFailed.Value()
+
+		Convey("When they are handled in parallel", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 100; i++ {
+				data := valid
+				if i%4 == 0 {
+					data = invalid
+				}
+				wg.Add(1)
+				go func(data []byte) {
+					defer wg.Done()
+					eventHandler(cfg, &nats.Msg{Data: data})
+				}(data)
+			}
+			wg.Wait()
+
+			Convey("It should count every event exactly once", func() {
+				So(eventsReceived.Value()-received, ShouldEqual, 100)
+				So(eventsCompleted.Value()-completed, ShouldEqual, 75)
+				So(eventsFailed.Value()-failed, ShouldEqual, 25)
+				So(len(fake.deleted), ShouldEqual, 75)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
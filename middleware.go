@@ -0,0 +1,221 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+var (
+	ErrRetryExhausted = errors.New("Event exceeded its budget of aws call attempts")
+	ErrCallTimeout    = errors.New("AWS call timed out")
+)
+
+var sleep = time.Sleep
+
+// newTimer starts the timer pause waits on
+var newTimer = time.NewTimer
+
+// pause waits out a delay, returning the context's error as soon as it
+// is done instead
+func pause(ctx context.Context, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t := newTimer(delay)
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
+
+// operation is a single call to the aws api, made with the given context
+type operation func(ctx context.Context) error
+
+// middleware wraps an operation with behaviour shared by all aws calls
+type middleware func(d *deletion, name string, next operation) operation
+
+// middlewares are applied in order, the first being the outermost
+var middlewares = []middleware{instrument, retry, deadline}
+
+// call runs an aws operation through the middleware chain
+func (d *deletion) call(name string, op operation) error {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		op = middlewares[i](d, name, op)
+	}
+	return op(d.ctx)
+}
+
+// instrument counts calls and failures per operation, and times them
+// per stage
+func instrument(d *deletion, name string, next operation) operation {
+	return func(ctx context.Context) error {
+		counterFor(fmt.Sprintf(`firewall_delete_aws_calls_total{operation="%s"}`, name)).Inc()
+
+		start := time.Now()
+		err := next(ctx)
+		d.timed(stageOf(name), time.Since(start))
+
+		if err != nil {
+			counterFor(fmt.Sprintf(`firewall_delete_aws_errors_total{operation="%s"}`, name)).Inc()
+		}
+
+		return err
+	}
+}
+
+// stageOf names the stage an operation belongs to after its verb, so
+// DescribeSecurityGroups and DescribeNetworkInterfaces are both describe
+func stageOf(name string) string {
+	i := strings.IndexFunc(name[1:], unicode.IsUpper)
+	if i < 0 {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name[:i+1])
+}
+
+// timed adds the time spent in a stage to the result and its metric
+func (d *deletion) timed(stage string, elapsed time.Duration) {
+	counterFor(fmt.Sprintf(`firewall_delete_aws_stage_milliseconds_total{stage="%s"}`, stage)).Add(int64(elapsed / time.Millisecond))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.result.Timings == nil {
+		d.result.Timings = make(map[string]time.Duration)
+	}
+	d.result.Timings[stage] += elapsed
+}
+
+// retry repeats an operation with exponential backoff while it fails
+// with a retryable error, counting whether it needed to
+func retry(d *deletion, name string, next operation) operation {
+	return func(ctx context.Context) error {
+		for attempt := 1; ; attempt++ {
+			if err := d.spendAttempt(); err != nil {
+				return err
+			}
+
+			err := next(ctx)
+			switch {
+			case err == nil && attempt == 1:
+				firstTrySuccess.Inc()
+				return nil
+			case err == nil:
+				retrySuccess.Inc()
+				return nil
+			case !retryable(err):
+				return err
+			case attempt >= d.retryAttempts():
+				retryExhausted.Inc()
+				return err
+			}
+
+			d.mu.Lock()
+			d.result.Retries++
+			d.mu.Unlock()
+			if err := pause(ctx, backoff(d.ev.cfg, attempt)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deadline gives each attempt of an operation its own CallTimeout,
+// nested under the event's context. A hung call fails with
+// ErrCallTimeout rather than blocking the event.
+func deadline(d *deletion, name string, next operation) operation {
+	return func(parent context.Context) error {
+		timeout := d.ev.cfg.CallTimeout
+		if timeout <= 0 {
+			return next(parent)
+		}
+
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+
+		err := next(ctx)
+		if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			log.Printf("%s timed out after %s", name, timeout)
+			return ErrCallTimeout
+		}
+
+		return err
+	}
+}
+
+// spendAttempt counts an aws call attempt against the event's budget
+func (d *deletion) spendAttempt() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if max := d.ev.cfg.MaxEventAttempts; max > 0 && d.attempts >= max {
+		return ErrRetryExhausted
+	}
+	d.attempts++
+
+	return nil
+}
+
+// retryAttempts is the retry budget of the deletion's event
+func (d *deletion) retryAttempts() int {
+	if d.ev.highPriority() {
+		return d.ev.cfg.PriorityRetryAttempts
+	}
+	return d.ev.cfg.RetryAttempts
+}
+
+// backoff returns the delay before retrying the given attempt. Full
+// jitter picks a delay up to the exponential backoff, equal jitter
+// keeps half of it and randomises the rest.
+func backoff(cfg *Config, attempt int) time.Duration {
+	d := cfg.RetryBaseDelay << uint(attempt-1)
+
+	switch cfg.RetryJitter {
+	case "none":
+		return d
+	case "equal":
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryableCodes are the aws error codes known to be transient. Any
+// other code, including ones the connector doesn't know about, is not
+// retried.
+var retryableCodes = map[string]bool{
+	"Throttling":           true,
+	"RequestLimitExceeded": true,
+}
+
+// isDependencyViolation checks if a group could not be deleted because
+// something still references it
+func isDependencyViolation(err error) bool {
+	return errorCode(err) == "DependencyViolation"
+}
+
+// retryable checks if an aws error is transient
+func retryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	return retryableCodes[aerr.Code()]
+}
@@ -0,0 +1,398 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func recorder(tag string, calls *[]string) middleware {
+	return func(d *deletion, name string, next operation) operation {
+		return func(ctx context.Context) error {
+			*calls = append(*calls, tag+":"+name)
+			return next(ctx)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	Convey("Given a middleware chain", t, func() {
+		cfg := defaultConfig()
+		original := middlewares
+		var calls []string
+		d := &deletion{ctx: context.Background(), ev: &Event{cfg: cfg}, result: &DeleteResult{}}
+
+		Convey("When calling an operation", func() {
+			middlewares = []middleware{recorder("first", &calls), recorder("second", &calls)}
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				calls = append(calls, "op")
+				return nil
+			})
+
+			Convey("It should run the middlewares in order around the operation", func() {
+				So(err, ShouldBeNil)
+				So(calls, ShouldResemble, []string{"first:DeleteSecurityGroup", "second:DeleteSecurityGroup", "op"})
+			})
+		})
+
+		Convey("When an operation is throttled", func() {
+			cfg.RetryJitter = "none"
+			var delays []time.Duration
+			newTimer = func(d time.Duration) *time.Timer {
+				delays = append(delays, d)
+				return time.NewTimer(0)
+			}
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				if attempts < 3 {
+					return awserr.New("Throttling", "rate exceeded", nil)
+				}
+				return nil
+			})
+
+			Convey("It should retry with backoff until it succeeds", func() {
+				So(err, ShouldBeNil)
+				So(attempts, ShouldEqual, 3)
+				So(d.result.Retries, ShouldEqual, 2)
+				So(delays, ShouldResemble, []time.Duration{cfg.RetryBaseDelay, cfg.RetryBaseDelay * 2})
+			})
+		})
+
+		Convey("When the event's context ends while backing off", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			d.ctx = ctx
+			newTimer = func(time.Duration) *time.Timer {
+				cancel()
+				return time.NewTimer(time.Hour)
+			}
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				return awserr.New("Throttling", "rate exceeded", nil)
+			})
+
+			Convey("It should stop retrying", func() {
+				So(err, ShouldEqual, context.Canceled)
+				So(attempts, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When a high priority operation stays throttled", func() {
+			newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+			d.ev = &Event{cfg: cfg, Priority: "high"}
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				return awserr.New("Throttling", "rate exceeded", nil)
+			})
+
+			Convey("It should use the elevated retry budget", func() {
+				So(err, ShouldNotBeNil)
+				So(attempts, ShouldEqual, cfg.PriorityRetryAttempts)
+				So(attempts, ShouldBeGreaterThan, cfg.RetryAttempts)
+			})
+		})
+
+		Convey("When a normal operation stays throttled", func() {
+			newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+			d.ev = &Event{cfg: cfg}
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				return awserr.New("Throttling", "rate exceeded", nil)
+			})
+
+			Convey("It should use the normal retry budget", func() {
+				So(err, ShouldNotBeNil)
+				So(attempts, ShouldEqual, cfg.RetryAttempts)
+			})
+		})
+
+		Convey("When an operation fails with a permanent error", func() {
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				return errors.New("boom")
+			})
+
+			Convey("It should not retry", func() {
+				So(err, ShouldNotBeNil)
+				So(attempts, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When an operation fails with an unknown aws error code", func() {
+			attempts := 0
+			err := d.call("DeleteSecurityGroup", func(ctx context.Context) error {
+				attempts++
+				return awserr.New("Fabricated.UnknownCode", "never heard of it", nil)
+			})
+
+			Convey("It should not retry and keep the raw code", func() {
+				So(attempts, ShouldEqual, 1)
+				So(d.result.Retries, ShouldEqual, 0)
+				So(resultCode(err), ShouldEqual, "Fabricated.UnknownCode")
+			})
+		})
+
+		Convey("When an operation is instrumented", func() {
+			calls := counterFor(`firewall_delete_aws_calls_total{operation="Test"}`).Value()
+			errs := counterFor(`firewall_delete_aws_errors_total{operation="Test"}`).Value()
+			d.call("Test", func(ctx context.Context) error { return errors.New("boom") })
+
+			Convey("It should count the call and the failure", func() {
+				So(counterFor(`firewall_delete_aws_calls_total{operation="Test"}`).Value(), ShouldEqual, calls+1)
+				So(counterFor(`firewall_delete_aws_errors_total{operation="Test"}`).Value(), ShouldEqual, errs+1)
+			})
+		})
+
+		Convey("When naming the stage of an operation", func() {
+			Convey("It should use the operation's verb", func() {
+				So(stageOf("DescribeNetworkInterfaces"), ShouldEqual, "describe")
+				So(stageOf("RevokeSecurityGroupEgress"), ShouldEqual, "revoke")
+				So(stageOf("DeleteSecurityGroup"), ShouldEqual, "delete")
+				So(stageOf("Test"), ShouldEqual, "test")
+			})
+		})
+
+		Convey("When counting how operations succeed", func() {
+			newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+			d.ev = &Event{cfg: cfg}
+			first, retried, exhausted := firstTrySuccess.Value(), retrySuccess.Value(), retryExhausted.Value()
+
+			throttled := func(failures int) operation {
+				attempts := 0
+				return func(ctx context.Context) error {
+					attempts++
+					if attempts <= failures {
+						return awserr.New("Throttling", "rate exceeded", nil)
+					}
+					return nil
+				}
+			}
+
+			Convey("It should count a first try success", func() {
+				d.call("DeleteSecurityGroup", throttled(0))
+				So(firstTrySuccess.Value(), ShouldEqual, first+1)
+				So(retrySuccess.Value(), ShouldEqual, retried)
+				So(retryExhausted.Value(), ShouldEqual, exhausted)
+			})
+
+			Convey("It should count a success after retrying", func() {
+				d.call("DeleteSecurityGroup", throttled(1))
+				So(firstTrySuccess.Value(), ShouldEqual, first)
+				So(retrySuccess.Value(), ShouldEqual, retried+1)
+				So(retryExhausted.Value(), ShouldEqual, exhausted)
+			})
+
+			Convey("It should count running out of retries", func() {
+				d.call("DeleteSecurityGroup", throttled(cfg.RetryAttempts))
+				So(firstTrySuccess.Value(), ShouldEqual, first)
+				So(retrySuccess.Value(), ShouldEqual, retried)
+				So(retryExhausted.Value(), ShouldEqual, exhausted+1)
+			})
+
+			Convey("It should count none of them for a permanent error", func() {
+				d.call("DeleteSecurityGroup", func(ctx context.Context) error { return errors.New("boom") })
+				So(firstTrySuccess.Value(), ShouldEqual, first)
+				So(retrySuccess.Value(), ShouldEqual, retried)
+				So(retryExhausted.Value(), ShouldEqual, exhausted)
+			})
+		})
+
+		Reset(func() {
+			middlewares = original
+			newTimer = time.NewTimer
+		})
+	})
+}
+
+func TestBackoffJitter(t *testing.T) {
+	Convey("Given exponential backoff", t, func() {
+		cfg := defaultConfig()
+		Convey("When using full jitter", func() {
+			cfg.RetryJitter = "full"
+			Convey("It should stay between zero and the backoff", func() {
+				for attempt := 1; attempt <= 4; attempt++ {
+					for i := 0; i < 100; i++ {
+						d := backoff(cfg, attempt)
+						So(d, ShouldBeGreaterThanOrEqualTo, 0)
+						So(d, ShouldBeLessThanOrEqualTo, cfg.RetryBaseDelay<<uint(attempt-1))
+					}
+				}
+			})
+		})
+
+		Convey("When using equal jitter", func() {
+			cfg.RetryJitter = "equal"
+			Convey("It should stay between half the backoff and the backoff", func() {
+				for attempt := 1; attempt <= 4; attempt++ {
+					for i := 0; i < 100; i++ {
+						d := backoff(cfg, attempt)
+						So(d, ShouldBeGreaterThanOrEqualTo, (cfg.RetryBaseDelay<<uint(attempt-1))/2)
+						So(d, ShouldBeLessThanOrEqualTo, cfg.RetryBaseDelay<<uint(attempt-1))
+					}
+				}
+			})
+		})
+
+		Convey("When jitter is disabled", func() {
+			cfg.RetryJitter = "none"
+			Convey("It should double the delay on each attempt", func() {
+				So(backoff(cfg, 1), ShouldEqual, cfg.RetryBaseDelay)
+				So(backoff(cfg, 3), ShouldEqual, cfg.RetryBaseDelay*4)
+			})
+		})
+	})
+}
+
+// stalledEC2 never answers describe calls until their context ends
+type stalledEC2 struct {
+	fakeEC2
+}
+
+func (f *stalledEC2) DescribeSecurityGroupsWithContext(ctx aws.Context, in *ec2.DescribeSecurityGroupsInput, opts ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// hungEC2 never answers delete calls until their context ends, the way
+// the sdk gives up on a request
+type hungEC2 struct {
+	fakeEC2
+}
+
+func (f *hungEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	<-ctx.Done()
+	return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+}
+
+func TestCallTimeout(t *testing.T) {
+	Convey("Given a per call timeout", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.CallTimeout = 20 * time.Millisecond
+		cfg.CompareRules = true
+		cfg.VerifyVPC = false
+
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &stalledEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When one aws call stalls", func() {
+			start := time.Now()
+			_, err := deleteFirewall(&ev)
+			elapsed := time.Since(start)
+
+			Convey("It should cut the call off and carry on with the event", func() {
+				So(err, ShouldBeNil)
+				So(elapsed, ShouldBeLessThan, time.Second)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the delete call hangs", func() {
+			cfg.CompareRules = false
+			hung := &hungEC2{}
+			useFakeEC2(hung)
+			start := time.Now()
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should give up with a timeout error", func() {
+				So(err, ShouldEqual, ErrCallTimeout)
+				So(resultCode(err), ShouldEqual, "timeout")
+				So(res.Status, ShouldEqual, statusFailed)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Convey("When the event runs out of time", func() {
+			cfg.CallTimeout = 0
+			cfg.EventTimeout = 20 * time.Millisecond
+			cfg.CompareRules = false
+			useFakeEC2(&hungEC2{})
+			start := time.Now()
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should give up on the event", func() {
+				So(errorCode(err), ShouldEqual, "RequestCanceled")
+				So(res.Status, ShouldEqual, statusCancelled)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestEventAttemptBudget(t *testing.T) {
+	Convey("Given an event whose revokes are always throttled", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+		cfg.RevokeBeforeDelete = true
+		cfg.RevokeChunkSize = 1
+		cfg.RetryAttempts = 10
+
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		for i := 0; i < 20; i++ {
+			ev.SecurityGroupRules.Ingress = append(ev.SecurityGroupRules.Ingress, ev.SecurityGroupRules.Ingress[0])
+		}
+		fake := &fakeEC2{}
+		for i := 0; i < 1000; i++ {
+			fake.revokeErrs = append(fake.revokeErrs, awserr.New("Throttling", "rate exceeded", nil))
+		}
+		restore := useFakeEC2(fake)
+
+		Convey("When the event has an attempt budget", func() {
+			cfg.MaxEventAttempts = 5
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should abort once every attempt is spent", func() {
+				So(err, ShouldEqual, ErrRetryExhausted)
+				So(resultCode(err), ShouldEqual, "retry_exhausted")
+				So(res.Status, ShouldEqual, "failed")
+				So(fake.describeCalls+fake.revokeCalls, ShouldEqual, 5)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the event has no attempt budget", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should retry every revoke in full", func() {
+				So(err, ShouldBeNil)
+				So(fake.revokeCalls, ShouldEqual, 22*10)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Reset(func() {
+			newTimer = time.NewTimer
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
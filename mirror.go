@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/nats-io/nats"
+)
+
+var (
+	ErrMirrorUnavailable = errors.New("Mirror cluster is not connected")
+)
+
+// mirror is the connection to the mirror cluster, dialled in the
+// background so an unreachable mirror never holds up the primary
+// connection or the events being processed
+var mirror struct {
+	sync.RWMutex
+	c *nats.Conn
+}
+
+// mirrorConn returns the mirror connection, nil until it is dialled
+func mirrorConn() *nats.Conn {
+	mirror.RLock()
+	defer mirror.RUnlock()
+	return mirror.c
+}
+
+// dialMirror connects to the mirror cluster in the background, trying
+// again every RedialDelay until it succeeds. A connection that closes,
+// having exhausted its reconnects, is dialled again the same way.
+func dialMirror(cfg *Config) {
+	go func() {
+		for {
+			c, err := connect(&Config{NatsURI: cfg.MirrorNatsURI, TLSMinVersion: cfg.TLSMinVersion})
+			if err == nil {
+				mirror.Lock()
+				mirror.c = c
+				mirror.Unlock()
+
+				c.SetClosedHandler(func(*nats.Conn) {
+					if mirrorConn() == c {
+						log.Println("Warning: the mirror connection closed, dialling it again")
+						dialMirror(cfg)
+					}
+				})
+				if !c.IsClosed() {
+					return
+				}
+			} else {
+				log.Printf("Warning: could not connect to the mirror: %s", err.Error())
+			}
+
+			sleep(cfg.RedialDelay)
+		}
+	}()
+}
+
+// closeMirror closes the mirror connection without dialling it again
+func closeMirror() {
+	mirror.Lock()
+	c := mirror.c
+	mirror.c = nil
+	mirror.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+}
+
+// publishMirror publishes a result to the mirror cluster. It never
+// waits for the mirror: results are refused while it is not connected,
+// and buffered by the client while it reconnects.
+func publishMirror(cfg *Config, subject string, data []byte) error {
+	c := mirrorConn()
+	if c == nil || c.IsClosed() {
+		return ErrMirrorUnavailable
+	}
+
+	return c.Publish(subject, data)
+}
+
+// flushMirror sends the results still buffered for the mirror cluster
+func flushMirror() {
+	c := mirrorConn()
+	if c == nil || c.IsClosed() {
+		return
+	}
+
+	if err := c.Flush(); err != nil {
+		log.Printf("Warning: could not flush results to the mirror: %s", err.Error())
+	}
+}
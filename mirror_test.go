@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMirror(t *testing.T) {
+	completed, _ := testSetup()
+
+	Convey("Given results are mirrored to a second cluster", t, func() {
+		cfg := defaultConfig()
+		opts := test.DefaultTestOptions
+		opts.Port = server.RANDOM_PORT
+		cluster := test.RunServer(&opts)
+
+		cfg.MirrorNatsURI = cluster.ClientURL()
+		cfg.ResultSinks = []string{"nats", "mirror"}
+
+		mc, err := nats.Connect(cfg.MirrorNatsURI)
+		So(err, ShouldBeNil)
+		mirrored := make(chan *nats.Msg, 10)
+		mc.ChanSubscribe("firewall.delete.aws.done", mirrored)
+		mc.Flush()
+
+		Convey("When the mirror is not connected yet", func() {
+			err := publishMirror(cfg, "firewall.delete.aws.done", []byte("{}"))
+
+			Convey("It should refuse the result without waiting", func() {
+				So(err, ShouldEqual, ErrMirrorUnavailable)
+			})
+		})
+
+		Convey("When an event completes", func() {
+			dialMirror(cfg)
+			for i := 0; i < 100 && mirrorConn() == nil; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			ev := testEvent
+			ev.cfg = cfg
+			ev.Status = "deleted"
+			ev.Complete()
+			flushMirror()
+
+			Convey("It should publish the result to both clusters", func() {
+				primary, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				replica, timeout := waitMsg(mirrored)
+				So(timeout, ShouldBeNil)
+				So(string(replica.Data), ShouldEqual, string(primary.Data))
+				So(string(replica.Data), ShouldContainSubstring, `"status":"deleted"`)
+			})
+		})
+
+		Reset(func() {
+			mc.Close()
+			closeMirror()
+			cluster.Shutdown()
+		})
+	})
+}
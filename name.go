@@ -0,0 +1,85 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var (
+	ErrSGNameNotFound = errors.New("No security group has the event's name")
+	ErrSGNameNotInVPC = errors.New("No security group with the event's name belongs to the datacenter VPC")
+)
+
+// byName checks if the event names its group instead of identifying it
+func (ev *Event) byName() bool {
+	return ev.cfg.DeleteByName && ev.SecurityGroupName != "" &&
+		ev.SecurityGroupAWSID == "" && ev.NetworkInterfaceID == "" && len(ev.SecurityGroupAWSIDs) == 0
+}
+
+// groupsNamed finds the groups to delete for the event's name, applying
+// NameConflictPolicy when more than one has it
+func (d *deletion) groupsNamed(name string) ([]string, error) {
+	req := ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("group-name"), Values: []*string{aws.String(name)}},
+		},
+	}
+
+	var groups []*ec2.SecurityGroup
+	err := d.call("DescribeSecurityGroups", func(ctx aws.Context) error {
+		resp, err := d.svc.DescribeSecurityGroupsWithContext(ctx, &req)
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return ErrEmptyResponse
+		}
+		groups = resp.SecurityGroups
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids, inVPC []string
+	for _, sg := range groups {
+		if sg == nil || aws.StringValue(sg.GroupName) != name {
+			continue
+		}
+		ids = append(ids, aws.StringValue(sg.GroupId))
+		if aws.StringValue(sg.VpcId) == d.ev.VPCID {
+			inVPC = append(inVPC, aws.StringValue(sg.GroupId))
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, ErrSGNameNotFound
+	}
+
+	switch d.ev.cfg.NameConflictPolicy {
+	case "delete_all":
+		return ids, nil
+	case "require_vpc":
+		switch len(inVPC) {
+		case 0:
+			return nil, ErrSGNameNotInVPC
+		case 1:
+			return inVPC, nil
+		}
+		ids = inVPC
+	}
+
+	if len(ids) == 1 {
+		return ids, nil
+	}
+
+	return nil, fmt.Errorf("%d security groups are named %s: %s", len(ids), name, strings.Join(ids, ", "))
+}
@@ -0,0 +1,144 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func namedGroup(id, name, vpc string) *ec2.SecurityGroup {
+	return &ec2.SecurityGroup{GroupId: aws.String(id), GroupName: aws.String(name), VpcId: aws.String(vpc)}
+}
+
+func TestDeleteByName(t *testing.T) {
+	Convey("Given an event with only a security group name", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		ev := testEvent
+		ev.cfg = cfg
+		ev.SecurityGroupAWSID = ""
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When deleting by name is disabled", func() {
+			err := ev.Validate()
+
+			Convey("It should reject the event", func() {
+				So(err, ShouldEqual, ErrSGAWSIDInvalid)
+			})
+		})
+
+		Convey("When deleting by name is enabled", func() {
+			cfg.DeleteByName = true
+
+			Convey("And a single group has the name", func() {
+				fake.groups = []*ec2.SecurityGroup{
+					namedGroup("sg-0000001", "test", "vpc-0000000"),
+					namedGroup("sg-0000009", "other", "vpc-0000000"),
+				}
+				So(ev.Validate(), ShouldBeNil)
+				res, err := deleteFirewall(&ev)
+
+				Convey("It should delete it", func() {
+					So(err, ShouldBeNil)
+					So(res.Status, ShouldEqual, "deleted")
+					So(fake.deleted, ShouldResemble, []string{"sg-0000001"})
+				})
+			})
+
+			Convey("And no group has the name", func() {
+				_, err := deleteFirewall(&ev)
+
+				Convey("It should error without deleting", func() {
+					So(err, ShouldEqual, ErrSGNameNotFound)
+					So(fake.deleted, ShouldBeEmpty)
+				})
+			})
+
+			Convey("And several groups have the name in different vpcs", func() {
+				fake.groups = []*ec2.SecurityGroup{
+					namedGroup("sg-0000001", "test", "vpc-0000000"),
+					namedGroup("sg-0000002", "test", "vpc-1111111"),
+				}
+
+				Convey("With the error policy", func() {
+					_, err := deleteFirewall(&ev)
+
+					Convey("It should error without deleting", func() {
+						So(err, ShouldNotBeNil)
+						So(err.Error(), ShouldEqual, "2 security groups are named test: sg-0000001, sg-0000002")
+						So(fake.deleted, ShouldBeEmpty)
+					})
+				})
+
+				Convey("With the require_vpc policy", func() {
+					cfg.NameConflictPolicy = "require_vpc"
+					_, err := deleteFirewall(&ev)
+
+					Convey("It should only delete the group in the event's vpc", func() {
+						So(err, ShouldBeNil)
+						So(fake.deleted, ShouldResemble, []string{"sg-0000001"})
+					})
+				})
+
+				Convey("With the require_vpc policy and none in the event's vpc", func() {
+					cfg.NameConflictPolicy = "require_vpc"
+					ev.VPCID = "vpc-2222222"
+					_, err := deleteFirewall(&ev)
+
+					Convey("It should error without deleting", func() {
+						So(err, ShouldEqual, ErrSGNameNotInVPC)
+						So(fake.deleted, ShouldBeEmpty)
+					})
+				})
+			})
+
+			Convey("And several groups have the name in the event's vpc", func() {
+				fake.groups = []*ec2.SecurityGroup{
+					namedGroup("sg-0000001", "test", "vpc-0000000"),
+					namedGroup("sg-0000002", "test", "vpc-0000000"),
+				}
+
+				Convey("With the require_vpc policy", func() {
+					cfg.NameConflictPolicy = "require_vpc"
+					_, err := deleteFirewall(&ev)
+
+					Convey("It should error without deleting", func() {
+						So(err, ShouldNotBeNil)
+						So(err.Error(), ShouldEqual, "2 security groups are named test: sg-0000001, sg-0000002")
+						So(fake.deleted, ShouldBeEmpty)
+					})
+				})
+
+				Convey("With the delete_all policy", func() {
+					cfg.NameConflictPolicy = "delete_all"
+					res, err := deleteFirewall(&ev)
+
+					Convey("It should delete all of them", func() {
+						So(err, ShouldBeNil)
+						So(res.Status, ShouldEqual, "deleted")
+						sort.Strings(fake.deleted)
+						So(fake.deleted, ShouldResemble, []string{"sg-0000001", "sg-0000002"})
+						So(ev.Results, ShouldHaveLength, 2)
+					})
+				})
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
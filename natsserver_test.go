@@ -0,0 +1,35 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+)
+
+var embedded struct {
+	sync.Once
+	server *server.Server
+}
+
+// testNatsURI returns the nats server the tests use: the one NATS_URI
+// points to when set, otherwise a server started in process for the
+// whole suite
+func testNatsURI() string {
+	if uri := os.Getenv("NATS_URI"); uri != "" {
+		return uri
+	}
+
+	embedded.Do(func() {
+		opts := test.DefaultTestOptions
+		opts.Port = server.RANDOM_PORT
+		embedded.server = test.RunServer(&opts)
+	})
+
+	return embedded.server.ClientURL()
+}
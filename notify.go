@@ -0,0 +1,71 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// sink delivers a terminal result to one destination
+type sink interface {
+	notify(cfg *Config, subject string, data []byte) error
+}
+
+type sinkFunc func(cfg *Config, subject string, data []byte) error
+
+func (f sinkFunc) notify(cfg *Config, subject string, data []byte) error {
+	return f(cfg, subject, data)
+}
+
+// stdout receives results sent to the stdout sink
+var stdout io.Writer = os.Stdout
+
+// sinks are the available result destinations by name
+var sinks = map[string]sink{
+	"nats": sinkFunc(func(cfg *Config, subject string, data []byte) error {
+		publish(cfg, subject, data)
+		return nil
+	}),
+	"webhook": sinkFunc(func(cfg *Config, subject string, data []byte) error {
+		return notifyWebhook(cfg, data)
+	}),
+	"stdout": sinkFunc(func(cfg *Config, subject string, data []byte) error {
+		_, err := fmt.Fprintf(stdout, "%s %s\n", subject, redactSecrets(data))
+		return err
+	}),
+	"file": sinkFunc(func(cfg *Config, subject string, data []byte) error {
+		return resultLog.write(cfg.ResultLogFile, cfg.ResultLogMaxBytes, data)
+	}),
+	"mirror": sinkFunc(publishMirror),
+}
+
+// dispatch sends a terminal result to every configured sink at once. A
+// failing sink is logged and counted without holding up the others.
+func dispatch(cfg *Config, subject string, data []byte) {
+	var wg sync.WaitGroup
+
+	for _, name := range cfg.ResultSinks {
+		s, ok := sinks[name]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(name string, s sink) {
+			defer wg.Done()
+
+			if err := s.notify(cfg, subject, data); err != nil {
+				counterFor(fmt.Sprintf(`firewall_delete_sink_errors_total{sink="%s"}`, name)).Inc()
+				log.Printf("Warning: could not deliver result to the %s sink: %s", name, err.Error())
+			}
+		}(name, s)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResultSinks(t *testing.T) {
+	Convey("Given a failing webhook and stdout as result sinks", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		cfg.WebhookURL = server.URL
+
+		var out bytes.Buffer
+		stdout = &out
+		cfg.ResultSinks = []string{"webhook", "stdout"}
+
+		failures := counterFor(`firewall_delete_sink_errors_total{sink="webhook"}`)
+		before := failures.Value()
+
+		Convey("When an event completes", func() {
+			ev := testEvent
+			ev.cfg = cfg
+			ev.Status = "deleted"
+			ev.Complete()
+
+			Convey("It should still deliver the result to stdout", func() {
+				So(out.String(), ShouldStartWith, "firewall.delete.aws.done {")
+				So(out.String(), ShouldContainSubstring, `"status":"deleted"`)
+			})
+
+			Convey("It should leave the credentials out of stdout", func() {
+				So(out.String(), ShouldNotContainSubstring, `"datacenter_secret"`)
+				So(out.String(), ShouldNotContainSubstring, `"datacenter_token"`)
+			})
+
+			Convey("It should count the webhook failure", func() {
+				So(failures.Value(), ShouldEqual, before+1)
+				So(counterFor(`firewall_delete_sink_errors_total{sink="stdout"}`).Value(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When an audited event sent as a request completes", func() {
+			cfg.AuditSubject = "firewall.delete.aws.audit"
+			ev := testEvent
+			ev.cfg = cfg
+			ev.reply = "test.reply.sinks"
+			ev.Status = "deleted"
+			ev.Complete()
+
+			Convey("It should only deliver the result to the sinks", func() {
+				So(out.String(), ShouldStartWith, "firewall.delete.aws.done {")
+				So(out.String(), ShouldNotContainSubstring, "test.reply.sinks")
+				So(out.String(), ShouldNotContainSubstring, "firewall.delete.aws.audit")
+			})
+		})
+
+		Reset(func() {
+			server.Close()
+			stdout = os.Stdout
+			newTimer = time.NewTimer
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
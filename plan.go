@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrPlanNotFound = errors.New("Batch plan not found or expired")
+
+// plan is a batch event waiting for confirmation
+type plan struct {
+	ev      Event
+	expires time.Time
+}
+
+var plans = struct {
+	sync.Mutex
+	pending map[string]plan
+}{pending: make(map[string]plan)}
+
+// needsPlan checks if the event is a batch that must be confirmed first
+func (ev *Event) needsPlan() bool {
+	return ev.cfg.ConfirmBatches && len(ev.SecurityGroupAWSIDs) > 0 && ev.PlanID == ""
+}
+
+// propose stores the batch as a plan and reports it on the plan subject
+// without deleting
+func propose(ev *Event) {
+	ev.PlanID = newClientToken()
+	expires := now().Add(ev.cfg.PlanTTL)
+
+	plans.Lock()
+	purgePlans()
+	plans.pending[ev.PlanID] = plan{ev: *ev, expires: expires}
+	plans.Unlock()
+
+	log.Printf("planned deletion of security groups %s as %s", ev.target(), ev.PlanID)
+	ev.Status = statusPlanned
+	ev.PlanExpiresAt = expires.UTC().Format(time.RFC3339)
+	ev.report(ev.cfg.PlanSubject)
+}
+
+// confirm replaces a confirmation with the batch event it confirms.
+// Plans are used once.
+func (ev *Event) confirm() error {
+	plans.Lock()
+	purgePlans()
+	p, ok := plans.pending[ev.PlanID]
+	delete(plans.pending, ev.PlanID)
+	plans.Unlock()
+
+	if !ok {
+		return ErrPlanNotFound
+	}
+
+	reply := ev.reply
+	*ev = p.ev
+	ev.reply = reply
+
+	log.Printf("plan %s confirmed", ev.PlanID)
+
+	return nil
+}
+
+// purgePlans drops expired plans. It must be called with plans locked.
+func purgePlans() {
+	t := now()
+	for id, p := range plans.pending {
+		if t.After(p.expires) {
+			delete(plans.pending, id)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBatchPlans(t *testing.T) {
+	completed, errored := testSetup()
+	plansCh := make(chan *nats.Msg, 10)
+	plansSub, _ := conn().ChanSubscribe("firewall.delete.aws.plan", plansCh)
+	defer plansSub.Unsubscribe()
+	audited := make(chan *nats.Msg, 10)
+	auditSub, _ := conn().ChanSubscribe("firewall.delete.aws.audit", audited)
+	defer auditSub.Unsubscribe()
+
+	Convey("Given batch deletes must be confirmed", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ConfirmBatches = true
+		cfg.PlanTTL = time.Minute
+		cfg.AuditSubject = "firewall.delete.aws.audit"
+		clock := time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)
+		now = func() time.Time { return clock }
+
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		ev := testEvent
+		ev.SecurityGroupAWSID = ""
+		ev.SecurityGroupAWSIDs = []string{"sg-0000001", "sg-0000002"}
+		data, _ := json.Marshal(ev)
+
+		var planned Event
+		eventHandler(cfg, &nats.Msg{Data: data})
+		msg, timeout := waitMsg(plansCh)
+		So(timeout, ShouldBeNil)
+		So(json.Unmarshal(msg.Data, &planned), ShouldBeNil)
+
+		confirmation, _ := json.Marshal(map[string]string{"plan_id": planned.PlanID})
+
+		Convey("When a batch event arrives", func() {
+			Convey("It should return a plan without deleting anything", func() {
+				So(planned.Status, ShouldEqual, "planned")
+				So(planned.PlanID, ShouldNotBeEmpty)
+				So(planned.PlanExpiresAt, ShouldEqual, "2016-10-01T00:01:00Z")
+				So(planned.SecurityGroupAWSIDs, ShouldResemble, []string{"sg-0000001", "sg-0000002"})
+				So(fake.deleted, ShouldBeEmpty)
+			})
+
+			Convey("It should not report the batch as completed", func() {
+				msg, _ := waitMsg(completed)
+				So(msg, ShouldBeNil)
+				msg, _ = waitMsg(audited)
+				So(msg, ShouldBeNil)
+			})
+		})
+
+		Convey("When the plan is confirmed", func() {
+			eventHandler(cfg, &nats.Msg{Data: confirmation})
+
+			Convey("It should delete the planned groups", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"deleted"`)
+				So(string(msg.Data), ShouldContainSubstring, `"plan_id":"`+planned.PlanID+`"`)
+				So(fake.deleted, ShouldHaveLength, 2)
+			})
+
+			Convey("And confirmed again", func() {
+				waitMsg(completed)
+				eventHandler(cfg, &nats.Msg{Data: confirmation})
+
+				Convey("It should reject the reused plan", func() {
+					msg, timeout := waitMsg(errored)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldContainSubstring, ErrPlanNotFound.Error())
+					So(fake.deleted, ShouldHaveLength, 2)
+				})
+			})
+		})
+
+		Convey("When the plan is confirmed after it expired", func() {
+			clock = clock.Add(2 * time.Minute)
+			eventHandler(cfg, &nats.Msg{Data: confirmation})
+
+			Convey("It should reject the confirmation without deleting", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, ErrPlanNotFound.Error())
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a single group event arrives", func() {
+			single, _ := json.Marshal(testEvent)
+			eventHandler(cfg, &nats.Msg{Data: single})
+
+			Convey("It should be deleted straight away", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"deleted"`)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Reset(func() {
+			restore()
+			now = time.Now
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
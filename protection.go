@@ -0,0 +1,28 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import "errors"
+
+var ErrSGProtected = errors.New("Security Group is protected from deletion")
+
+// checkProtection refuses to delete groups tagged with ProtectionTag
+func (d *deletion) checkProtection(id string) error {
+	tag := d.ev.cfg.ProtectionTag
+	if tag == "" {
+		return nil
+	}
+
+	sg, err := d.group(id)
+	if err != nil || sg == nil {
+		return err
+	}
+
+	if hasTag(sg, tag) {
+		return ErrSGProtected
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func taggedGroup(id string, tags map[string]string) *ec2.SecurityGroup {
+	sg := &ec2.SecurityGroup{GroupId: aws.String(id), VpcId: aws.String("vpc-0000000")}
+	for k, v := range tags {
+		sg.Tags = append(sg.Tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return sg
+}
+
+func TestProtectionTag(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given a protection tag is configured", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ProtectionTag = "ernest:protected=true"
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When the group carries the tag", func() {
+			fake.groups = []*ec2.SecurityGroup{taggedGroup("sg-0000000", map[string]string{"ernest:protected": "true"})}
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should refuse to delete it", func() {
+				So(fake.deleted, ShouldBeEmpty)
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"protected"`)
+			})
+		})
+
+		Convey("When the group carries the tag with another value", func() {
+			fake.groups = []*ec2.SecurityGroup{taggedGroup("sg-0000000", map[string]string{"ernest:protected": "false"})}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete it", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the group is not tagged", func() {
+			fake.groups = []*ec2.SecurityGroup{taggedGroup("sg-0000000", nil)}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete it", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Reset(func() {
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestVPCVerification(t *testing.T) {
+	Convey("Given a group in another vpc than the event's", t, func() {
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.cfg = cfg
+		fake := &fakeEC2{}
+		fake.groups = []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-1111111")}}
+		restore := useFakeEC2(fake)
+
+		Convey("When deleting it", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should refuse to delete it", func() {
+				So(err, ShouldEqual, ErrSGVPCMismatch)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the vpc check is disabled", func() {
+			cfg.VerifyVPC = false
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete it", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the group is in the event's vpc", func() {
+			fake.groups[0].VpcId = aws.String("vpc-0000000")
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should delete it", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Reset(restore)
+	})
+}
@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/nats-io/nats"
+)
+
+var pending = &resultBuffer{}
+
+// redial replaces a closed nats connection, nil leaves closed
+// connections to be handled by reconnecting
+var redial func() (*nats.Conn, error)
+
+var redialMu sync.Mutex
+
+type result struct {
+	subject string
+	data    []byte
+	// reply marks an answer to a request, never spooled as its inbox
+	// doesn't outlive the requester
+	reply bool
+}
+
+// resultBuffer holds terminal results that could not be published,
+// spooling them to path when set
+type resultBuffer struct {
+	mu      sync.Mutex
+	results []result
+	path    string
+	// limit caps the results kept, zero keeps them all
+	limit int
+}
+
+// push stores a result, dropping the oldest one when the buffer is full
+func (b *resultBuffer) push(r result) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limit > 0 && len(b.results) >= b.limit {
+		log.Printf("Warning: pending results buffer full, dropping result for %s", b.results[0].subject)
+		b.results = b.results[1:]
+	}
+
+	b.results = append(b.results, r)
+	b.save()
+}
+
+// flush publishes all buffered results on the given connection
+func (b *resultBuffer) flush(c *nats.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	defer b.save()
+
+	for i, r := range b.results {
+		if err := c.Publish(r.subject, r.data); err != nil {
+			b.results = b.results[i:]
+			return
+		}
+	}
+
+	b.results = nil
+}
+
+// len returns the number of buffered results
+func (b *resultBuffer) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.results)
+}
+
+// publish sends a result, buffering it if the connection is unavailable
+func publish(cfg *Config, subject string, data []byte) {
+	send(cfg, result{subject: subject, data: data})
+}
+
+// publishReply answers a request, buffering the reply like a result while
+// the connection is unavailable but never spooling it
+func publishReply(cfg *Config, subject string, data []byte) {
+	send(cfg, result{subject: subject, data: data, reply: true})
+}
+
+// send publishes a message, buffering it if the connection is
+// unavailable. A closed connection won't reconnect by itself, so it is
+// re-established first.
+func send(cfg *Config, r result) {
+	c := conn()
+	if c.IsConnected() {
+		if err := c.Publish(r.subject, r.data); err == nil {
+			return
+		}
+	}
+
+	if c.IsClosed() && republish(cfg, r.subject, r.data) {
+		return
+	}
+
+	pending.push(r)
+}
+
+// republish re-establishes a closed connection and publishes on it,
+// trying up to RedialAttempts times
+func republish(cfg *Config, subject string, data []byte) bool {
+	redialMu.Lock()
+	defer redialMu.Unlock()
+
+	if redial == nil {
+		return false
+	}
+
+	for attempt := 1; attempt <= cfg.RedialAttempts; attempt++ {
+		if c := conn(); !c.IsClosed() {
+			return c.Publish(subject, data) == nil
+		}
+
+		c, err := redial()
+		if err == nil {
+			log.Println("re-established the closed nats connection")
+			setConn(c)
+			pending.flush(c)
+			return c.Publish(subject, data) == nil
+		}
+
+		log.Printf("Warning: could not re-establish the nats connection: %s", err.Error())
+		if attempt < cfg.RedialAttempts {
+			sleep(cfg.RedialDelay)
+		}
+	}
+
+	return false
+}
+
+// shardSubject returns the subject a result for the given uuid is
+// published to among shards, always picking the same shard for a uuid
+func shardSubject(subject, uuid string, shards int) string {
+	if shards <= 1 {
+		return subject
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+
+	return fmt.Sprintf("%s.%d", subject, h.Sum32()%uint32(shards))
+}
+
+// reconnected flushes any results buffered while disconnected
+func reconnected(c *nats.Conn) {
+	log.Println("reconnected to nats, flushing pending results")
+	pending.flush(c)
+}
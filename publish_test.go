@@ -0,0 +1,313 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPublish(t *testing.T) {
+	completed, _ := testSetup()
+	live := conn()
+
+	Convey("Given a disconnected nats connection", t, func() {
+		cfg := defaultConfig()
+		closed, err := nats.Connect(testNatsURI())
+		So(err, ShouldBeNil)
+		closed.Close()
+		setConn(closed)
+
+		Convey("When completing an event", func() {
+			e := Event{cfg: cfg}
+			e.UUID = "pending"
+			e.Complete()
+
+			Convey("It should buffer the result", func() {
+				So(pending.len(), ShouldEqual, 1)
+				msg, timeout := waitMsg(completed)
+				So(msg, ShouldBeNil)
+				So(timeout, ShouldNotBeNil)
+			})
+
+			Convey("And the connection is re-established", func() {
+				setConn(live)
+				reconnected(live)
+
+				Convey("It should deliver the buffered result", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldContainSubstring, `"_uuid":"pending"`)
+					So(pending.len(), ShouldEqual, 0)
+				})
+			})
+		})
+
+		Convey("When more results than the limit are buffered", func() {
+			log.SetOutput(ioutil.Discard)
+			pending = &resultBuffer{limit: 2}
+
+			publish(cfg, "firewall.delete.aws.done", []byte("1"))
+			publish(cfg, "firewall.delete.aws.done", []byte("2"))
+			publish(cfg, "firewall.delete.aws.done", []byte("3"))
+
+			Convey("It should drop the oldest result", func() {
+				So(pending.len(), ShouldEqual, 2)
+				reconnected(live)
+				msg, _ := waitMsg(completed)
+				So(string(msg.Data), ShouldEqual, "2")
+				msg, _ = waitMsg(completed)
+				So(string(msg.Data), ShouldEqual, "3")
+			})
+
+			log.SetOutput(os.Stdout)
+		})
+
+		Reset(func() {
+			setConn(live)
+			pending = &resultBuffer{}
+		})
+	})
+}
+
+func TestRedial(t *testing.T) {
+	completed, _ := testSetup()
+	live := conn()
+
+	Convey("Given a nats connection closed at runtime", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		closed, err := nats.Connect(testNatsURI())
+		So(err, ShouldBeNil)
+		closed.Close()
+		setConn(closed)
+
+		var delays []time.Duration
+		sleep = func(d time.Duration) { delays = append(delays, d) }
+		dials := 0
+
+		Convey("When it can be re-established", func() {
+			redial = func() (*nats.Conn, error) {
+				dials++
+				if dials < 2 {
+					return nil, errors.New("connection refused")
+				}
+				return live, nil
+			}
+			publish(cfg, "firewall.delete.aws.done", []byte("recovered"))
+
+			Convey("It should reconnect and publish the result", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldEqual, "recovered")
+				So(dials, ShouldEqual, 2)
+				So(delays, ShouldResemble, []time.Duration{cfg.RedialDelay})
+				So(conn(), ShouldEqual, live)
+				So(pending.len(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When results are published concurrently", func() {
+			redial = func() (*nats.Conn, error) {
+				return live, nil
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					publish(cfg, "firewall.delete.aws.done", []byte("concurrent"))
+					heartbeat("test.heartbeat")
+				}()
+			}
+			wg.Wait()
+
+			Convey("It should publish every result on the re-established connection", func() {
+				So(conn(), ShouldEqual, live)
+				for i := 0; i < 10; i++ {
+					_, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+				}
+			})
+		})
+
+		Convey("When it stays down", func() {
+			redial = func() (*nats.Conn, error) {
+				dials++
+				return nil, errors.New("connection refused")
+			}
+			publish(cfg, "firewall.delete.aws.done", []byte("lost"))
+
+			Convey("It should give up after the bounded attempts and buffer the result", func() {
+				So(dials, ShouldEqual, cfg.RedialAttempts)
+				So(pending.len(), ShouldEqual, 1)
+			})
+		})
+
+		Reset(func() {
+			setConn(live)
+			redial = nil
+			sleep = time.Sleep
+			pending = &resultBuffer{}
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestResultSpool(t *testing.T) {
+	completed, _ := testSetup()
+	live := conn()
+
+	Convey("Given a result spool and a disconnected nats connection", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		dir, _ := ioutil.TempDir("", "spool")
+		path := filepath.Join(dir, "results")
+
+		var err error
+		pending, err = openSpool(path, cfg.PendingResultsLimit)
+		So(err, ShouldBeNil)
+
+		closed, err := nats.Connect(testNatsURI())
+		So(err, ShouldBeNil)
+		closed.Close()
+		setConn(closed)
+
+		Convey("When completing events during the outage", func() {
+			e := testEvent
+			e.UUID = "spooled-1"
+			e.Complete()
+			e.UUID = "spooled-2"
+			e.Complete()
+
+			Convey("It should write them to the spool", func() {
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(strings.Count(string(data), "\n"), ShouldEqual, 2)
+			})
+
+			Convey("And the connector restarts once nats recovers", func() {
+				pending, err = openSpool(path, cfg.PendingResultsLimit)
+				So(err, ShouldBeNil)
+				So(pending.len(), ShouldEqual, 2)
+				So(string(pending.results[0].data), ShouldNotContainSubstring, `"datacenter_secret"`)
+				So(string(pending.results[0].data), ShouldNotContainSubstring, `"datacenter_token"`)
+
+				setConn(live)
+				pending.flush(live)
+
+				Convey("It should publish the spooled results in order and clear the spool", func() {
+					msg, timeout := waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldContainSubstring, `"_uuid":"spooled-1"`)
+					msg, timeout = waitMsg(completed)
+					So(timeout, ShouldBeNil)
+					So(string(msg.Data), ShouldContainSubstring, `"_uuid":"spooled-2"`)
+					So(pending.len(), ShouldEqual, 0)
+					_, err := os.Stat(path)
+					So(os.IsNotExist(err), ShouldBeTrue)
+				})
+			})
+		})
+
+		Convey("When answering a request during the outage", func() {
+			e := testEvent
+			e.reply = "test.reply.spool"
+			e.Complete()
+
+			Convey("It should buffer the reply without spooling it", func() {
+				So(pending.len(), ShouldEqual, 2)
+				reopened, err := openSpool(path, cfg.PendingResultsLimit)
+				So(err, ShouldBeNil)
+				So(reopened.len(), ShouldEqual, 1)
+				So(reopened.results[0].subject, ShouldEqual, "firewall.delete.aws.done")
+			})
+		})
+
+		Convey("When the spool holds more than the limit", func() {
+			publish(cfg, "firewall.delete.aws.done", []byte("1"))
+			publish(cfg, "firewall.delete.aws.done", []byte("2"))
+			publish(cfg, "firewall.delete.aws.done", []byte("3"))
+			pending, err = openSpool(path, 2)
+
+			Convey("It should keep only the newest results", func() {
+				So(err, ShouldBeNil)
+				So(pending.len(), ShouldEqual, 2)
+				So(string(pending.results[0].data), ShouldEqual, "2")
+			})
+		})
+
+		Reset(func() {
+			setConn(live)
+			pending = &resultBuffer{}
+			os.RemoveAll(dir)
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestResultShards(t *testing.T) {
+	testSetup()
+
+	Convey("Given results sharded across subjects", t, func() {
+		cfg := defaultConfig()
+		cfg.ResultShards = 4
+		sharded := make(chan *nats.Msg, 10)
+		sub, _ := conn().ChanSubscribe("firewall.delete.aws.done.*", sharded)
+
+		Convey("When picking the subject for a uuid", func() {
+			subject := shardSubject("firewall.delete.aws.done", "test", cfg.ResultShards)
+
+			Convey("It should always pick the same shard", func() {
+				So(subject, ShouldStartWith, "firewall.delete.aws.done.")
+				for i := 0; i < 10; i++ {
+					So(shardSubject("firewall.delete.aws.done", "test", cfg.ResultShards), ShouldEqual, subject)
+				}
+			})
+
+			Convey("It should spread uuids across shards", func() {
+				shards := make(map[string]bool)
+				for _, uuid := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+					shards[shardSubject("firewall.delete.aws.done", uuid, cfg.ResultShards)] = true
+				}
+				So(len(shards), ShouldBeGreaterThan, 1)
+				So(len(shards), ShouldBeLessThanOrEqualTo, 4)
+			})
+		})
+
+		Convey("When completing an event", func() {
+			e := testEvent
+			e.cfg = cfg
+			e.Complete()
+
+			Convey("It should publish to the uuid's shard", func() {
+				msg, timeout := waitMsg(sharded)
+				So(timeout, ShouldBeNil)
+				So(msg.Subject, ShouldEqual, shardSubject("firewall.delete.aws.done", "test", cfg.ResultShards))
+			})
+		})
+
+		Convey("When sharding is disabled", func() {
+			Convey("It should keep the single subject", func() {
+				So(shardSubject("firewall.delete.aws.done", "test", 0), ShouldEqual, "firewall.delete.aws.done")
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+		})
+	})
+}
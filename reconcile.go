@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// reconcileSubject is the subject batch reconciliations are published on
+func reconcileSubject(cfg *Config) string {
+	return cfg.SubjectPrefix + ".delete.aws.reconcile"
+}
+
+// reconciliation lists the groups of a batch still present after it
+type reconciliation struct {
+	UUID                string   `json:"_uuid"`
+	BatchID             string   `json:"_batch_id"`
+	SecurityGroupAWSIDs []string `json:"security_group_aws_ids"`
+	Survivors           []string `json:"survivors"`
+	Unchecked           []string `json:"unchecked,omitempty"`
+}
+
+// reconcile checks which of the given groups still exist and publishes
+// the outcome, catching deletes that reported success without taking
+// effect. Groups that cannot be described are listed as unchecked.
+func (d *deletion) reconcile(ids []string) {
+	r := reconciliation{
+		UUID:                d.ev.UUID,
+		BatchID:             d.ev.BatchID,
+		SecurityGroupAWSIDs: ids,
+		Survivors:           []string{},
+	}
+
+	for _, id := range ids {
+		absent, err := d.groupAbsent(id)
+		switch {
+		case err != nil:
+			log.Printf("Warning: could not reconcile security group %s: %s", id, err.Error())
+			r.Unchecked = append(r.Unchecked, id)
+		case !absent:
+			log.Printf("Warning: security group %s still exists after its batch", id)
+			r.Survivors = append(r.Survivors, id)
+		}
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Warning: could not encode the reconciliation of %s: %s", d.ev.UUID, err.Error())
+		return
+	}
+
+	publish(d.ev.cfg, reconcileSubject(d.ev.cfg), data)
+}
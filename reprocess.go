@@ -0,0 +1,129 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// retrySubject is the subject retry commands arrive on
+func retrySubject(cfg *Config) string {
+	return cfg.SubjectPrefix + ".delete.aws.retry"
+}
+
+// retryCommand asks for a failed event to be processed again
+type retryCommand struct {
+	UUID string `json:"_uuid"`
+}
+
+var failedEvents = newFailedStore()
+
+// failedStore keeps the raw payload of recently failed events by uuid,
+// dropping the oldest one when full
+type failedStore struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type failedEvent struct {
+	uuid    string
+	data    []byte
+	expires time.Time
+}
+
+func newFailedStore() *failedStore {
+	return &failedStore{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// put keeps a failed event for ttl, keeping at most size events
+func (s *failedStore) put(uuid string, data []byte, ttl time.Duration, size int) {
+	if uuid == "" || data == nil || size <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &failedEvent{uuid: uuid, data: data, expires: now().Add(ttl)}
+	if e, ok := s.entries[uuid]; ok {
+		e.Value = entry
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.entries[uuid] = s.order.PushFront(entry)
+
+	for s.order.Len() > size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*failedEvent).uuid)
+	}
+}
+
+// take removes and returns a failed event that has not expired. If it
+// fails again it is kept anew.
+func (s *failedStore) take(uuid string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[uuid]
+	if !ok {
+		return nil, false
+	}
+
+	s.order.Remove(e)
+	delete(s.entries, uuid)
+
+	entry := e.Value.(*failedEvent)
+	if now().After(entry.expires) {
+		return nil, false
+	}
+
+	return entry.data, true
+}
+
+// subscribeRetry registers the retry handler when failed events are kept
+func subscribeRetry(cfg *Config, c *nats.Conn) (*nats.Subscription, error) {
+	if !cfg.ReprocessFailed {
+		return nil, nil
+	}
+
+	log.Printf("listening for %s", retrySubject(cfg))
+	return c.Subscribe(retrySubject(cfg), func(m *nats.Msg) {
+		retryHandler(cfg, m)
+	})
+}
+
+// retryHandler runs a failed event again as if it had just arrived.
+// Every replica receives the command, only the one that kept the event
+// acts on it.
+func retryHandler(cfg *Config, m *nats.Msg) {
+	defer exitOnPanic()
+
+	var cmd retryCommand
+	if err := json.Unmarshal(m.Data, &cmd); err != nil || cmd.UUID == "" {
+		log.Printf("Warning: ignoring retry command without an event uuid")
+		return
+	}
+
+	data, ok := failedEvents.take(cmd.UUID)
+	if !ok {
+		log.Printf("no failed event %s to retry", cmd.UUID)
+		return
+	}
+
+	log.Printf("retrying failed event %s", cmd.UUID)
+	eventHandler(cfg, &nats.Msg{Subject: deleteSubject(cfg), Reply: m.Reply, Data: data})
+}
@@ -0,0 +1,92 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReprocessFailed(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given failed events are kept for retries", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.ReprocessFailed = true
+		cfg.SubjectPrefix = "test.firewall"
+		fake := &fakeEC2{deleteErr: errors.New("boom")}
+		restore := useFakeEC2(fake)
+
+		sub, err := subscribeRetry(cfg, conn())
+		So(err, ShouldBeNil)
+
+		ev := testEvent
+		ev.UUID = "reprocess"
+		data, _ := json.Marshal(ev)
+		eventHandler(cfg, &nats.Msg{Data: data})
+		_, timeout := waitMsg(errored)
+		So(timeout, ShouldBeNil)
+
+		fake.deleteErr = nil
+		retry, _ := json.Marshal(retryCommand{UUID: "reprocess"})
+
+		Convey("When an operator retries the failed event", func() {
+			msg, rerr := conn().Request("test.firewall.delete.aws.retry", retry, time.Second)
+
+			Convey("It should process the original event again", func() {
+				So(rerr, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"_uuid":"reprocess"`)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"deleted"`)
+				So(string(msg.Data), ShouldNotContainSubstring, `"error"`)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+
+			Convey("It should only retry it once", func() {
+				_, rerr := conn().Request("test.firewall.delete.aws.retry", retry, 100*time.Millisecond)
+				So(rerr, ShouldNotBeNil)
+				So(fake.deleted, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the failed event has expired", func() {
+			now = func() time.Time { return time.Now().Add(2 * cfg.ReprocessTTL) }
+			_, rerr := conn().Request("test.firewall.delete.aws.retry", retry, 100*time.Millisecond)
+
+			Convey("It should not be retried", func() {
+				So(rerr, ShouldNotBeNil)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the store is full", func() {
+			failedEvents.put("newer", []byte(`{}`), cfg.ReprocessTTL, 1)
+			_, ok := failedEvents.take("reprocess")
+
+			Convey("It should drop the oldest failed event", func() {
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Reset(func() {
+			if sub != nil {
+				sub.Unsubscribe()
+			}
+			failedEvents = newFailedStore()
+			now = time.Now
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
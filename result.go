@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// statuses published on results, and on each group of a batch.
+// Consumers branch on them, so they only change with a major version.
+const (
+	// statusDeleted: the group was deleted by this event
+	statusDeleted = "deleted"
+	// statusAlreadyAbsent: the group was gone before this event deleted it
+	statusAlreadyAbsent = "already_absent"
+	// statusSkipped: the group was not deleted on purpose, such as a
+	// duplicate id in a batch
+	statusSkipped = "skipped"
+	// statusProtected: the group carries the protection tag
+	statusProtected = "protected"
+	// statusCancelled: the deletion was interrupted before it finished
+	statusCancelled = "cancelled"
+	// statusFailed: the deletion failed
+	statusFailed = "failed"
+	// statusDryRun: the event was explained without calling aws
+	statusDryRun = "dry_run"
+	// statusObserved: the connector runs observe only and deleted nothing
+	statusObserved = "observed"
+	// statusPlanned: the batch waits for a confirmation of its plan
+	statusPlanned = "planned"
+)
+
+// DeleteResult describes the outcome of deleting an event's groups
+type DeleteResult struct {
+	Status             string
+	DeletedIDs         []string
+	AlreadyDeleted     []string
+	RevokedRules       int
+	Retries            int
+	Duration           time.Duration
+	ClientRequestToken string
+	// Timings is the time spent in each stage: describe, revoke, delete
+	Timings map[string]time.Duration
+}
+
+// deletion holds the state shared by the aws calls made for one event
+type deletion struct {
+	ctx    context.Context
+	ev     *Event
+	svc    ec2Client
+	result *DeleteResult
+
+	// attempts counts the aws call attempts made for the event
+	attempts int
+
+	// described caches groups looked up before deleting them
+	described map[string]*ec2.SecurityGroup
+
+	// mu guards the result and cache while a batch is deleted concurrently
+	mu sync.Mutex
+}
+
+// statusOf maps the error returned by a deletion to its result status
+func statusOf(res *DeleteResult, err error) string {
+	switch err {
+	case nil:
+		if len(res.DeletedIDs) == 0 && len(res.AlreadyDeleted) > 0 {
+			return statusAlreadyAbsent
+		}
+		return statusDeleted
+	case ErrSGProtected:
+		return statusProtected
+	}
+
+	if isCancelled(err) {
+		return statusCancelled
+	}
+	return statusFailed
+}
+
+// isCancelled checks if an error interrupted a deletion rather than
+// reporting its failure
+func isCancelled(err error) bool {
+	switch err {
+	case context.Canceled, context.DeadlineExceeded:
+		return true
+	}
+	return errorCode(err) == request.CanceledErrorCode
+}
+
+// wasAlreadyDeleted checks if a group was found to be gone before this
+// deletion removed it
+func (d *deletion) wasAlreadyDeleted(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.result.wasAlreadyDeleted(id)
+}
+
+func (res *DeleteResult) wasAlreadyDeleted(id string) bool {
+	for _, a := range res.AlreadyDeleted {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// apply copies a delete result onto the event
+func (ev *Event) apply(res *DeleteResult) {
+	if res == nil {
+		return
+	}
+
+	ev.Status = res.Status
+	ev.DeletedIDs = res.DeletedIDs
+	ev.AlreadyDeleted = res.AlreadyDeleted
+	ev.RevokedRules = res.RevokedRules
+	ev.Retries = res.Retries
+	ev.DurationMS = int64(res.Duration / time.Millisecond)
+	ev.ClientRequestToken = res.ClientRequestToken
+
+	ev.TimingsMS = nil
+	for stage, t := range res.Timings {
+		if ev.TimingsMS == nil {
+			ev.TimingsMS = make(map[string]int64)
+		}
+		ev.TimingsMS[stage] = int64(t / time.Millisecond)
+	}
+}
@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeleteResult(t *testing.T) {
+	completed, errored := testSetup()
+
+	Convey("Given an event with rules to revoke", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.RevokeBeforeDelete = true
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When the delete succeeds after a throttled revoke", func() {
+			fake.revokeErrs = []error{awserr.New("Throttling", "rate exceeded", nil)}
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should return the result of the deletion", func() {
+				So(err, ShouldBeNil)
+				So(res.Status, ShouldEqual, "deleted")
+				So(res.DeletedIDs, ShouldResemble, []string{"sg-0000000"})
+				So(res.RevokedRules, ShouldEqual, 2)
+				So(res.Retries, ShouldEqual, 1)
+				So(res.Duration, ShouldBeGreaterThan, 0)
+			})
+		})
+
+		Convey("When the delete fails", func() {
+			fake.deleteErr = errors.New("boom")
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should return a failed result", func() {
+				So(err, ShouldNotBeNil)
+				So(res.Status, ShouldEqual, "failed")
+				So(res.DeletedIDs, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the event is handled", func() {
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish the result fields on the done event", func() {
+				msg, timeout := waitMsg(completed)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"deleted"`)
+				So(string(msg.Data), ShouldContainSubstring, `"deleted_ids":["sg-0000000"]`)
+				So(string(msg.Data), ShouldContainSubstring, `"revoked_rules":2`)
+			})
+		})
+
+		Convey("When the event fails to be handled", func() {
+			fake.deleteErr = errors.New("boom")
+			data, _ := json.Marshal(ev)
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should publish the failed status on the error event", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, `"status":"failed"`)
+			})
+		})
+
+		Reset(func() {
+			newTimer = time.NewTimer
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestStatuses(t *testing.T) {
+	Convey("Given the outcome of a deletion", t, func() {
+		tests := []struct {
+			desc   string
+			res    DeleteResult
+			err    error
+			status string
+		}{
+			{"a deleted group", DeleteResult{DeletedIDs: []string{"sg-0000000"}}, nil, "deleted"},
+			{"a group that was already gone", DeleteResult{AlreadyDeleted: []string{"sg-0000000"}}, nil, "already_absent"},
+			{"a protected group", DeleteResult{}, ErrSGProtected, "protected"},
+			{"a cancelled context", DeleteResult{}, context.Canceled, "cancelled"},
+			{"an expired context", DeleteResult{}, context.DeadlineExceeded, "cancelled"},
+			{"a cancelled aws call", DeleteResult{}, awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), "cancelled"},
+			{"an aws failure", DeleteResult{}, awserr.New("DependencyViolation", "in use", nil), "failed"},
+		}
+
+		for _, tt := range tests {
+			tt := tt
+			Convey("When the deletion ends with "+tt.desc, func() {
+				So(statusOf(&tt.res, tt.err), ShouldEqual, tt.status)
+			})
+		}
+	})
+}
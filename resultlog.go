@@ -0,0 +1,97 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+var resultLog = &rotatingFile{}
+
+// rotatingFile appends lines to the result log, rotating it by size
+type rotatingFile struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// write appends a result to path as a single compact json line without
+// its secrets, first rotating the file to path.1 when the line would take
+// it past maxBytes
+func (r *rotatingFile) write(path string, maxBytes int, data []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, redactSecrets(data)); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		if err := r.open(path); err != nil {
+			return err
+		}
+	}
+
+	if r.size > 0 && r.size+int64(line.Len()) > int64(maxBytes) {
+		if err := r.rotate(path); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.f.Write(line.Bytes())
+	r.size += int64(n)
+	return err
+}
+
+// open appends to the result log, picking up the size of what an
+// earlier run left in it
+func (r *rotatingFile) open(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the full result log aside and starts a new one
+func (r *rotatingFile) rotate(path string) error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+
+	return r.open(path)
+}
+
+// close closes the result log so the next write reopens it
+func (r *rotatingFile) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.f.Close()
+	r.f, r.size = nil, 0
+	return err
+}
@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResultLog(t *testing.T) {
+	Convey("Given results are logged to a file", t, func() {
+		cfg := defaultConfig()
+		dir, _ := ioutil.TempDir("", "result-log")
+		cfg.ResultLogFile = filepath.Join(dir, "results.ndjson")
+		cfg.ResultSinks = []string{"file"}
+
+		lines := func(path string) []string {
+			data, err := ioutil.ReadFile(path)
+			So(err, ShouldBeNil)
+			return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		}
+
+		Convey("When events complete", func() {
+			for _, id := range []string{"sg-0000001", "sg-0000002"} {
+				ev := testEvent
+				ev.cfg = cfg
+				ev.SecurityGroupAWSID = id
+				ev.Status = "deleted"
+				ev.Complete()
+			}
+
+			Convey("It should append one json line per result", func() {
+				written := lines(cfg.ResultLogFile)
+				So(written, ShouldHaveLength, 2)
+				for _, line := range written {
+					var res map[string]interface{}
+					So(json.Unmarshal([]byte(line), &res), ShouldBeNil)
+					So(res["status"], ShouldEqual, "deleted")
+				}
+				So(written[1], ShouldContainSubstring, `"sg-0000002"`)
+			})
+
+			Convey("It should leave the credentials out", func() {
+				for _, line := range lines(cfg.ResultLogFile) {
+					So(line, ShouldNotContainSubstring, `"datacenter_secret"`)
+					So(line, ShouldNotContainSubstring, `"datacenter_token"`)
+				}
+			})
+		})
+
+		Convey("When the log grows past its limit", func() {
+			cfg.ResultLogMaxBytes = 50
+			for i := 0; i < 3; i++ {
+				dispatch(cfg, "firewall.delete.aws.done", []byte(`{
+					"status": "deleted",
+					"security_group_aws_id": "sg-0000000"
+				}`))
+			}
+
+			Convey("It should rotate it", func() {
+				So(lines(cfg.ResultLogFile), ShouldResemble, []string{`{"status":"deleted","security_group_aws_id":"sg-0000000"}`})
+				So(lines(cfg.ResultLogFile+".1"), ShouldHaveLength, 1)
+			})
+		})
+
+		Reset(func() {
+			resultLog.close()
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,169 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// revokeBeforeDelete checks if the event's rules should be revoked,
+// letting the event override RevokeBeforeDelete
+func (ev *Event) revokeBeforeDelete() bool {
+	if ev.Revoke != nil {
+		return *ev.Revoke
+	}
+	return ev.cfg.RevokeBeforeDelete
+}
+
+// permissions converts rules to the ec2 representation, ipv6 ranges
+// going in Ipv6Ranges
+func permissions(rules []rule) []*ec2.IpPermission {
+	var perms []*ec2.IpPermission
+
+	for _, r := range rules {
+		protocol, from, to := normalRule(r.Protocol, r.FromPort, r.ToPort)
+		p := &ec2.IpPermission{
+			IpProtocol: aws.String(protocol),
+			FromPort:   aws.Int64(from),
+			ToPort:     aws.Int64(to),
+		}
+
+		if isIPv6(r.IP) {
+			p.Ipv6Ranges = []*ec2.Ipv6Range{{CidrIpv6: aws.String(r.IP)}}
+		} else {
+			p.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(r.IP)}}
+		}
+
+		perms = append(perms, p)
+	}
+
+	return perms
+}
+
+// isIPv6 checks if a rule's cidr is an ipv6 range
+func isIPv6(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// isPermissionNotFound checks if a revoked rule was already absent
+func isPermissionNotFound(err error) bool {
+	return errorCode(err) == "InvalidPermission.NotFound"
+}
+
+// matchingRules keeps the rules present on the group, warning about
+// the ones that are not
+func matchingRules(direction string, rules []rule, present map[string]bool) []rule {
+	var matching []rule
+
+	for _, r := range rules {
+		key := ruleKey(direction, r.Protocol, r.FromPort, r.ToPort, r.IP)
+		if !present[key] {
+			log.Printf("Warning: rule %s is not on the security group, skipping revoke", key)
+			continue
+		}
+		matching = append(matching, r)
+	}
+
+	return matching
+}
+
+// revokeRules removes the event's ingress and egress rules from the
+// group. When the group can be described only the rules it actually has
+// are revoked, otherwise all of the event's rules are tried.
+func (d *deletion) revokeRules() error {
+	ingressRules := d.ev.SecurityGroupRules.Ingress
+	egressRules := d.ev.SecurityGroupRules.Egress
+
+	if sg, err := d.group(d.ev.SecurityGroupAWSID); err == nil && sg != nil {
+		present := make(map[string]bool)
+		for _, k := range groupRuleKeys(sg) {
+			present[k] = true
+		}
+
+		ingressRules = matchingRules("ingress", ingressRules, present)
+		egressRules = matchingRules("egress", egressRules, present)
+	}
+
+	var errs revokeErrors
+	id := aws.String(d.ev.SecurityGroupAWSID)
+
+	for _, perms := range chunk(permissions(ingressRules), d.ev.cfg.RevokeChunkSize) {
+		req := ec2.RevokeSecurityGroupIngressInput{GroupId: id, IpPermissions: perms}
+
+		err := d.call("RevokeSecurityGroupIngress", func(ctx aws.Context) error {
+			_, err := d.svc.RevokeSecurityGroupIngressWithContext(ctx, &req)
+			return err
+		})
+		errs = d.revoked(len(perms), err, errs)
+	}
+
+	for _, perms := range chunk(permissions(egressRules), d.ev.cfg.RevokeChunkSize) {
+		req := ec2.RevokeSecurityGroupEgressInput{GroupId: id, IpPermissions: perms}
+
+		err := d.call("RevokeSecurityGroupEgress", func(ctx aws.Context) error {
+			_, err := d.svc.RevokeSecurityGroupEgressWithContext(ctx, &req)
+			return err
+		})
+		errs = d.revoked(len(perms), err, errs)
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	return errs
+}
+
+// revoked records the outcome of revoking a chunk of rules, ignoring
+// rules that were already absent
+func (d *deletion) revoked(n int, err error, errs revokeErrors) revokeErrors {
+	if err == nil {
+		d.result.RevokedRules += n
+		return errs
+	}
+
+	if isPermissionNotFound(err) {
+		return errs
+	}
+
+	return append(errs, err)
+}
+
+// chunk splits permissions into batches of at most size
+func chunk(perms []*ec2.IpPermission, size int) [][]*ec2.IpPermission {
+	var chunks [][]*ec2.IpPermission
+
+	for size > 0 && len(perms) > size {
+		chunks = append(chunks, perms[:size])
+		perms = perms[size:]
+	}
+
+	if len(perms) > 0 {
+		chunks = append(chunks, perms)
+	}
+
+	return chunks
+}
+
+// revokeErrors lists the failures of several revoke calls
+type revokeErrors []error
+
+func (e revokeErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d revoke calls failed: %s", len(e), strings.Join(msgs, "; "))
+}
@@ -0,0 +1,366 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPermissions(t *testing.T) {
+	Convey("Given rules as events spell them", t, func() {
+		rules := []rule{
+			{IP: "10.0.0.0/16", FromPort: 80, ToPort: 80, Protocol: "TCP"},
+			{IP: "0.0.0.0/0", FromPort: -1, ToPort: -1, Protocol: "all"},
+			{IP: "2001:db8::/64", FromPort: 443, ToPort: 443, Protocol: "6"},
+		}
+
+		Convey("When converting them to ec2 permissions", func() {
+			perms := permissions(rules)
+
+			Convey("It should use the protocols and ports aws reports", func() {
+				So(aws.StringValue(perms[0].IpProtocol), ShouldEqual, "tcp")
+				So(aws.StringValue(perms[1].IpProtocol), ShouldEqual, "-1")
+				So(aws.Int64Value(perms[1].FromPort), ShouldEqual, 0)
+				So(aws.Int64Value(perms[1].ToPort), ShouldEqual, 0)
+				So(aws.StringValue(perms[2].IpProtocol), ShouldEqual, "tcp")
+			})
+
+			Convey("It should put ipv6 ranges in Ipv6Ranges", func() {
+				So(perms[0].Ipv6Ranges, ShouldBeEmpty)
+				So(perms[2].IpRanges, ShouldBeEmpty)
+				So(aws.StringValue(perms[2].Ipv6Ranges[0].CidrIpv6), ShouldEqual, "2001:db8::/64")
+			})
+		})
+	})
+}
+
+func TestRevokeBeforeDelete(t *testing.T) {
+	Convey("Given revoke before delete is enabled", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.RevokeBeforeDelete = true
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+
+		Convey("When deleting a group", func() {
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should revoke the rules then delete the group", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:10.0.10.100/32", "egress:8.8.8.8/32"})
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When timing a deletion", func() {
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should time every stage it went through", func() {
+				So(err, ShouldBeNil)
+				So(res.Timings, ShouldContainKey, "describe")
+				So(res.Timings, ShouldContainKey, "revoke")
+				So(res.Timings, ShouldContainKey, "delete")
+				So(res.Timings, ShouldHaveLength, 3)
+			})
+
+			Convey("It should publish them in milliseconds", func() {
+				e := Event{}
+				e.apply(res)
+				So(e.TimingsMS, ShouldHaveLength, 3)
+			})
+		})
+
+		Convey("When a revoke is throttled once", func() {
+			fake.revokeErrs = []error{awserr.New("RequestLimitExceeded", "throttled", nil)}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should retry the revoke and delete the group", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:10.0.10.100/32", "egress:8.8.8.8/32"})
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When a revoked rule no longer exists", func() {
+			fake.revokeErrs = []error{awserr.New("InvalidPermission.NotFound", "not found", nil)}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should carry on with the deletion", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the group only has some of the event's rules", func() {
+			sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}
+			sg.IpPermissions = []*ec2.IpPermission{permission("tcp", 80, 8080, "10.0.10.100/32")}
+			sg.IpPermissionsEgress = []*ec2.IpPermission{permission("tcp", 443, 443, "8.8.8.8/32")}
+			fake.groups = []*ec2.SecurityGroup{sg}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should only revoke the rules the group has", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:10.0.10.100/32"})
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the event spells the group's rules differently", func() {
+			ev.SecurityGroupRules.Ingress = []rule{
+				{IP: "10.0.10.100/32", FromPort: 80, ToPort: 8080, Protocol: "TCP"},
+				{IP: "10.0.20.0/24", FromPort: 53, ToPort: 53, Protocol: "17"},
+			}
+			ev.SecurityGroupRules.Egress = []rule{
+				{IP: "0.0.0.0/0", FromPort: -1, ToPort: -1, Protocol: "all"},
+			}
+			sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}
+			sg.IpPermissions = []*ec2.IpPermission{
+				permission("tcp", 80, 8080, "10.0.10.100/32"),
+				permission("udp", 53, 53, "10.0.20.0/24"),
+			}
+			sg.IpPermissionsEgress = []*ec2.IpPermission{{IpProtocol: aws.String("-1"), IpRanges: []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}}}
+			fake.groups = []*ec2.SecurityGroup{sg}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should still match and revoke them", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:10.0.10.100/32", "ingress:10.0.20.0/24", "egress:0.0.0.0/0"})
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the group has an ipv6 rule of the event", func() {
+			ev.SecurityGroupRules.Ingress = []rule{{IP: "2001:db8::/64", FromPort: 443, ToPort: 443, Protocol: "tcp"}}
+			ev.SecurityGroupRules.Egress = nil
+			sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}
+			sg.IpPermissions = []*ec2.IpPermission{{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int64(443),
+				ToPort:     aws.Int64(443),
+				Ipv6Ranges: []*ec2.Ipv6Range{{CidrIpv6: aws.String("2001:db8::/64")}},
+			}}
+			fake.groups = []*ec2.SecurityGroup{sg}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should revoke it as an ipv6 range", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:2001:db8::/64"})
+			})
+		})
+
+		Convey("When the group belongs to another vpc", func() {
+			sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-1111111")}
+			sg.IpPermissions = []*ec2.IpPermission{permission("tcp", 80, 8080, "10.0.10.100/32")}
+			fake.groups = []*ec2.SecurityGroup{sg}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should refuse before revoking any rule", func() {
+				So(err, ShouldEqual, ErrSGVPCMismatch)
+				So(fake.revoked, ShouldBeEmpty)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the group is protected", func() {
+			cfg.ProtectionTag = "protected"
+			sg := &ec2.SecurityGroup{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}
+			sg.IpPermissions = []*ec2.IpPermission{permission("tcp", 80, 8080, "10.0.10.100/32")}
+			sg.Tags = []*ec2.Tag{{Key: aws.String("protected"), Value: aws.String("true")}}
+			fake.groups = []*ec2.SecurityGroup{sg}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should refuse before revoking any rule", func() {
+				So(err, ShouldEqual, ErrSGProtected)
+				So(fake.revoked, ShouldBeEmpty)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When the group has none of the event's rules", func() {
+			fake.groups = []*ec2.SecurityGroup{{GroupId: aws.String("sg-0000000"), VpcId: aws.String("vpc-0000000")}}
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should not revoke anything", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldBeEmpty)
+				So(res.RevokedRules, ShouldEqual, 0)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When there are more rules than fit in one call", func() {
+			cfg.RevokeChunkSize = 2
+			for i := 0; i < 4; i++ {
+				ev.SecurityGroupRules.Ingress = append(ev.SecurityGroupRules.Ingress, rule{
+					IP:       fmt.Sprintf("10.0.1.%d/32", i),
+					FromPort: 22,
+					ToPort:   22,
+					Protocol: "tcp",
+				})
+			}
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should revoke them in several calls", func() {
+				So(err, ShouldBeNil)
+				So(res.RevokedRules, ShouldEqual, 6)
+				So(fake.revokeCalls, ShouldEqual, 4)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When several chunks fail in strict mode", func() {
+			cfg.RevokeStrict = true
+			cfg.RevokeChunkSize = 1
+			fake.revokeErrs = []error{
+				awserr.New("UnauthorizedOperation", "denied", nil),
+				awserr.New("InvalidParameterValue", "bad rule", nil),
+			}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should report every failure and not delete the group", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "2 revoke calls failed")
+				So(err.Error(), ShouldContainSubstring, "UnauthorizedOperation")
+				So(err.Error(), ShouldContainSubstring, "InvalidParameterValue")
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a revoke fails in strict mode", func() {
+			cfg.RevokeStrict = true
+			fake.revokeErrs = []error{awserr.New("UnauthorizedOperation", "denied", nil)}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not delete the group", func() {
+				So(err, ShouldNotBeNil)
+				So(fake.deleted, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a revoke fails in best effort mode", func() {
+			fake.revokeErrs = []error{awserr.New("UnauthorizedOperation", "denied", nil)}
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should still delete the group", func() {
+				So(err, ShouldBeNil)
+				So(res.RevokedRules, ShouldEqual, 1)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the event has no rules and rules are optional", func() {
+			ev.SecurityGroupRules.Ingress = nil
+			ev.SecurityGroupRules.Egress = nil
+			verr := ev.Validate()
+			res, err := deleteFirewall(&ev)
+
+			Convey("It should skip the revoke and delete the group", func() {
+				So(verr, ShouldBeNil)
+				So(err, ShouldBeNil)
+				So(fake.revokeCalls, ShouldEqual, 0)
+				So(res.Timings, ShouldNotContainKey, "revoke")
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+
+			Convey("It should explain the revoke is skipped", func() {
+				So(ev.trace(), ShouldContain, "revoke: skipped, the event has no rules")
+			})
+		})
+
+		Convey("When the event has no rules and rules are required", func() {
+			cfg.RequireRules = true
+			ev.SecurityGroupRules.Ingress = nil
+			ev.SecurityGroupRules.Egress = nil
+
+			Convey("It should reject the event", func() {
+				So(ev.Validate(), ShouldEqual, ErrSGRulesInvalid)
+			})
+		})
+
+		Convey("When a revoked rule no longer exists in strict mode", func() {
+			cfg.RevokeStrict = true
+			fake.revokeErrs = []error{awserr.New("InvalidPermission.NotFound", "not found", nil)}
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should carry on with the deletion", func() {
+				So(err, ShouldBeNil)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Reset(func() {
+			newTimer = time.NewTimer
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
+
+func TestRevokePerEvent(t *testing.T) {
+	Convey("Given an event with rules", t, func() {
+		cfg := defaultConfig()
+		ev := testEvent
+		ev.cfg = cfg
+		buildTestRules(&ev)
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+		on, off := true, false
+
+		Convey("When the event asks for a revoke that is globally off", func() {
+			ev.Revoke = &on
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should revoke the rules", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldResemble, []string{"ingress:10.0.10.100/32", "egress:8.8.8.8/32"})
+			})
+		})
+
+		Convey("When the event skips a revoke that is globally on", func() {
+			cfg.RevokeBeforeDelete = true
+			ev.Revoke = &off
+			_, err := deleteFirewall(&ev)
+
+			Convey("It should not revoke the rules", func() {
+				So(err, ShouldBeNil)
+				So(fake.revoked, ShouldBeEmpty)
+				So(fake.deleted, ShouldResemble, []string{"sg-0000000"})
+			})
+		})
+
+		Convey("When the event doesn't say", func() {
+			cfg.RevokeBeforeDelete = true
+			data, _ := json.Marshal(ev)
+			e := Event{cfg: cfg}
+			e.Process(data)
+			_, err := deleteFirewall(&e)
+
+			Convey("It should follow the global setting", func() {
+				So(err, ShouldBeNil)
+				So(e.Revoke, ShouldBeNil)
+				So(fake.revoked, ShouldHaveLength, 2)
+			})
+		})
+
+		Reset(restore)
+	})
+}
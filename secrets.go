@@ -0,0 +1,85 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// secretFields are the event fields never sent outside nats, nor written
+// to audit records
+var secretFields = []string{"datacenter_secret", "datacenter_token", "datacenter_access_session_token", "datacenter_external_id"}
+
+// redactSecrets removes the secret fields from a json payload. Payloads
+// without any, or that aren't a json object, are returned unchanged.
+func redactSecrets(data []byte) []byte {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return data
+	}
+
+	found := false
+	for _, key := range secretFields {
+		if _, ok := fields[key]; ok {
+			delete(fields, key)
+			found = true
+		}
+	}
+	if !found {
+		return data
+	}
+
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+// readSecretFile loads a value from the file configured by an env var,
+// returning an empty string when no file is configured
+func readSecretFile(env, path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %s", env, err.Error())
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// applySecretFiles fills empty datacenter fields from mounted secret
+// files, following the *_FILE convention
+func applySecretFiles(ev *Event) error {
+	fields := []struct {
+		env   string
+		path  string
+		value *string
+	}{
+		{"DATACENTER_ACCESS_KEY_FILE", ev.cfg.AccessKeyFile, &ev.DatacenterAccessKey},
+		{"DATACENTER_ACCESS_TOKEN_FILE", ev.cfg.AccessTokenFile, &ev.DatacenterAccessToken},
+		{"DATACENTER_REGION_FILE", ev.cfg.RegionFile, &ev.DatacenterRegion},
+	}
+
+	for _, f := range fields {
+		if *f.value != "" {
+			continue
+		}
+
+		v, err := readSecretFile(f.env, f.path)
+		if err != nil {
+			return err
+		}
+		*f.value = v
+	}
+
+	return nil
+}
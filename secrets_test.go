@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSecretFiles(t *testing.T) {
+	Convey("Given credentials mounted as files", t, func() {
+		cfg := defaultConfig()
+		dir, _ := ioutil.TempDir("", "secrets")
+		ioutil.WriteFile(filepath.Join(dir, "key"), []byte("file-key\n"), 0600)
+		ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600)
+		ioutil.WriteFile(filepath.Join(dir, "region"), []byte("eu-west-2"), 0600)
+		cfg.AccessKeyFile = filepath.Join(dir, "key")
+		cfg.AccessTokenFile = filepath.Join(dir, "token")
+		cfg.RegionFile = filepath.Join(dir, "region")
+
+		Convey("When the event carries no credentials", func() {
+			ev := testEvent
+			ev.cfg = cfg
+			ev.DatacenterAccessKey = ""
+			ev.DatacenterAccessToken = ""
+			ev.DatacenterRegion = ""
+			err := applySecretFiles(&ev)
+
+			Convey("It should read them from the files", func() {
+				So(err, ShouldBeNil)
+				So(ev.DatacenterAccessKey, ShouldEqual, "file-key")
+				So(ev.DatacenterAccessToken, ShouldEqual, "file-token")
+				So(ev.DatacenterRegion, ShouldEqual, "eu-west-2")
+				So(ev.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("When the event carries credentials", func() {
+			ev := testEvent
+			ev.cfg = cfg
+			err := applySecretFiles(&ev)
+
+			Convey("It should keep the event values", func() {
+				So(err, ShouldBeNil)
+				So(ev.DatacenterAccessKey, ShouldEqual, "key")
+				So(ev.DatacenterAccessToken, ShouldEqual, "token")
+				So(ev.DatacenterRegion, ShouldEqual, "eu-west-1")
+			})
+		})
+
+		Convey("When a file is missing", func() {
+			cfg.AccessKeyFile = filepath.Join(dir, "missing")
+			ev := testEvent
+			ev.cfg = cfg
+			ev.DatacenterAccessKey = ""
+			err := applySecretFiles(&ev)
+
+			Convey("It should error", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "DATACENTER_ACCESS_KEY_FILE")
+			})
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
+
+func TestRedactSecrets(t *testing.T) {
+	Convey("Given a result payload", t, func() {
+		Convey("When it carries credentials", func() {
+			data := redactSecrets([]byte(`{"_uuid":"test","datacenter_secret":"key","datacenter_token":"token","datacenter_access_session_token":"session"}`))
+
+			Convey("It should remove them", func() {
+				So(string(data), ShouldEqual, `{"_uuid":"test"}`)
+			})
+		})
+
+		Convey("When it carries none", func() {
+			data := redactSecrets([]byte(`{"status":"deleted","_uuid":"test"}`))
+
+			Convey("It should leave it untouched", func() {
+				So(string(data), ShouldEqual, `{"status":"deleted","_uuid":"test"}`)
+			})
+		})
+
+		Convey("When it isn't a json object", func() {
+			data := redactSecrets([]byte(`not json`))
+
+			Convey("It should leave it untouched", func() {
+				So(string(data), ShouldEqual, `not json`)
+			})
+		})
+	})
+}
@@ -0,0 +1,110 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type spooled struct {
+	Subject string `json:"subject"`
+	Data    []byte `json:"data"`
+}
+
+// openSpool builds the pending results buffer keeping up to limit
+// results, loading any results spooled by a previous run
+func openSpool(path string, limit int) (*resultBuffer, error) {
+	b := &resultBuffer{path: path, limit: limit}
+	if path == "" {
+		return b, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var s spooled
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			log.Printf("Warning: skipping unreadable spooled result: %s", err.Error())
+			continue
+		}
+		b.results = append(b.results, result{subject: s.Subject, data: s.Data})
+	}
+
+	if limit > 0 && len(b.results) > limit {
+		b.results = b.results[len(b.results)-limit:]
+	}
+
+	return b, scanner.Err()
+}
+
+// save rewrites the spool with the buffered results. It must be called
+// with the buffer locked.
+func (b *resultBuffer) save() {
+	if b.path == "" {
+		return
+	}
+
+	if err := writeSpool(b.path, b.results); err != nil {
+		log.Printf("Warning: could not write the result spool: %s", err.Error())
+	}
+}
+
+// writeSpool replaces the spool file atomically, one result per line.
+// Results are spooled without their secrets, and replies not at all.
+func writeSpool(path string, results []result) error {
+	var spool []spooled
+	for _, r := range results {
+		if !r.reply {
+			spool = append(spool, spooled{Subject: r.subject, Data: redactSecrets(r.data)})
+		}
+	}
+
+	if len(spool) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, s := range spool {
+		if err := enc.Encode(s); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats"
+)
+
+// parseTLSVersion converts a version such as 1.2 to its tls constant
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS_MIN_VERSION %q is not supported, use 1.2 or 1.3", v)
+}
+
+// tlsConfig builds the tls configuration used for outgoing connections
+func tlsConfig(minVersion uint16) *tls.Config {
+	return &tls.Config{MinVersion: minVersion}
+}
+
+// newHTTPClient builds an http client enforcing the minimum tls version,
+// keeping the default transport's proxy, dial and idle connection settings
+func newHTTPClient(minVersion uint16) *http.Client {
+	def := http.DefaultTransport.(*http.Transport)
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 def.Proxy,
+			DialContext:           def.DialContext,
+			MaxIdleConns:          def.MaxIdleConns,
+			IdleConnTimeout:       def.IdleConnTimeout,
+			TLSHandshakeTimeout:   def.TLSHandshakeTimeout,
+			ExpectContinueTimeout: def.ExpectContinueTimeout,
+			TLSClientConfig:       tlsConfig(minVersion),
+		},
+	}
+}
+
+// connectSecure connects to nats servers over tls
+func connectSecure(uri string, minVersion uint16) (*nats.Conn, error) {
+	return nats.Connect(uri, nats.Secure(tlsConfig(minVersion)))
+}
+
+// usesTLS checks if the nats uri requires a tls connection
+func usesTLS(uri string) bool {
+	return strings.HasPrefix(uri, "tls://")
+}
@@ -0,0 +1,62 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTLSMinVersion(t *testing.T) {
+	Convey("Given the default tls settings", t, func() {
+		Convey("When building an aws config", func() {
+			cfg := awsConfig(&testEvent)
+			transport := cfg.HTTPClient.Transport.(*http.Transport)
+
+			Convey("It should require tls 1.2", func() {
+				So(transport.TLSClientConfig.MinVersion, ShouldEqual, tls.VersionTLS12)
+				So(tlsConfig(defaultConfig().TLSMinVersion).MinVersion, ShouldEqual, tls.VersionTLS12)
+			})
+
+			Convey("It should keep the default transport's timeouts", func() {
+				def := http.DefaultTransport.(*http.Transport)
+				So(transport.DialContext, ShouldNotBeNil)
+				So(transport.TLSHandshakeTimeout, ShouldEqual, def.TLSHandshakeTimeout)
+				So(transport.IdleConnTimeout, ShouldEqual, def.IdleConnTimeout)
+				So(transport.MaxIdleConns, ShouldEqual, def.MaxIdleConns)
+				So(transport.ExpectContinueTimeout, ShouldEqual, def.ExpectContinueTimeout)
+			})
+		})
+	})
+
+	Convey("Given a minimum tls version of 1.3", t, func() {
+		cfg, err := loadConfig(testEnv(map[string]string{
+			"NATS_URI":        "nats://127.0.0.1:4222",
+			"TLS_MIN_VERSION": "1.3",
+		}))
+		So(err, ShouldBeNil)
+		ev := testEvent
+		ev.cfg = cfg
+
+		Convey("When building the nats and aws tls configs", func() {
+			transport := awsConfig(&ev).HTTPClient.Transport.(*http.Transport)
+
+			Convey("It should require tls 1.3", func() {
+				So(tlsConfig(cfg.TLSMinVersion).MinVersion, ShouldEqual, tls.VersionTLS13)
+				So(transport.TLSClientConfig.MinVersion, ShouldEqual, tls.VersionTLS13)
+			})
+		})
+	})
+
+	Convey("Given an unsupported tls version", t, func() {
+		_, err := parseTLSVersion("1.0")
+		Convey("It should error", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,50 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import "sync"
+
+// vpcLocks serializes deletes within a vpc when SerializeVPC is set
+var vpcLocks = newKeyedLock()
+
+// keyedLock hands out a mutex per key, forgetting it once nobody holds
+// or waits for it
+type keyedLock struct {
+	mu    sync.Mutex
+	locks map[string]*refLock
+}
+
+type refLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedLock() *keyedLock {
+	return &keyedLock{locks: make(map[string]*refLock)}
+}
+
+// lock blocks until key is free, returning the func that releases it
+func (k *keyedLock) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &refLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
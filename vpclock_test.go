@@ -0,0 +1,107 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// gatedEC2 holds every deletion until it is released
+type gatedEC2 struct {
+	fakeEC2
+	entered chan string
+	release chan struct{}
+}
+
+func (f *gatedEC2) DeleteSecurityGroupWithContext(ctx aws.Context, in *ec2.DeleteSecurityGroupInput, opts ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	f.entered <- aws.StringValue(in.GroupId)
+	<-f.release
+	return f.fakeEC2.DeleteSecurityGroupWithContext(ctx, in, opts...)
+}
+
+func TestSerializeVPC(t *testing.T) {
+	testSetup()
+
+	Convey("Given several workers serializing deletes per vpc", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		cfg.NatsURI = testNatsURI()
+		cfg.SubjectPrefix = "test.workers"
+		cfg.SerializeVPC = true
+		fake := &gatedEC2{entered: make(chan string, 2), release: make(chan struct{})}
+		restore := useFakeEC2(fake)
+
+		live := subscription
+		events = newWorkerPool(2)
+		c, err := listen(cfg)
+		So(err, ShouldBeNil)
+
+		remove := func(id, vpc string) {
+			ev := testEvent
+			ev.SecurityGroupAWSID = id
+			ev.VPCID = vpc
+			data, _ := json.Marshal(ev)
+			So(c.Publish(deleteSubject(cfg), data), ShouldBeNil)
+		}
+
+		entered := func() []string {
+			var ids []string
+			for {
+				select {
+				case id := <-fake.entered:
+					ids = append(ids, id)
+				case <-time.After(50 * time.Millisecond):
+					return ids
+				}
+			}
+		}
+
+		Convey("When two events target the same vpc", func() {
+			remove("sg-0000001", "vpc-0000000")
+			remove("sg-0000002", "vpc-0000000")
+
+			Convey("It should delete one group at a time", func() {
+				So(entered(), ShouldHaveLength, 1)
+				fake.release <- struct{}{}
+				So(entered(), ShouldHaveLength, 1)
+				fake.release <- struct{}{}
+				events.wait(0)
+				So(fake.deleted, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("When two events target different vpcs", func() {
+			remove("sg-0000001", "vpc-0000000")
+			remove("sg-0000002", "vpc-1111111")
+
+			Convey("It should delete both groups at once", func() {
+				So(entered(), ShouldHaveLength, 2)
+				close(fake.release)
+				events.wait(0)
+				So(fake.deleted, ShouldHaveLength, 2)
+				So(vpcLocks.locks, ShouldBeEmpty)
+			})
+		})
+
+		Reset(func() {
+			c.Close()
+			events = nil
+			subscription = live
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+)
+
+// sign returns the hex encoded hmac-sha256 of a body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook sends a result to the webhook once
+func postWebhook(ctx context.Context, cfg *Config, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, cfg.WebhookURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.WebhookSecret != "" {
+		req.Header.Set("X-Signature", "sha256="+sign(cfg.WebhookSecret, data))
+	}
+
+	resp, err := cfg.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// notifyWebhook delivers a terminal result to the webhook without its
+// secrets, retrying with backoff when it fails. WebhookTimeout bounds the
+// whole delivery, so a slow webhook can't hold up the events behind it.
+func notifyWebhook(cfg *Config, data []byte) error {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+	data = redactSecrets(data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WebhookTimeout)
+	defer cancel()
+
+	var err error
+	for attempt := 1; attempt <= cfg.WebhookAttempts; attempt++ {
+		if err = postWebhook(ctx, cfg, data); err == nil {
+			return nil
+		}
+		if attempt < cfg.WebhookAttempts {
+			if perr := pause(ctx, backoff(cfg, attempt)); perr != nil {
+				return err
+			}
+		}
+	}
+
+	return err
+}
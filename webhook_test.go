@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhook(t *testing.T) {
+	testSetup()
+
+	Convey("Given a webhook is configured", t, func() {
+		cfg := defaultConfig()
+		log.SetOutput(ioutil.Discard)
+		newTimer = func(time.Duration) *time.Timer { return time.NewTimer(0) }
+
+		var mu sync.Mutex
+		var bodies [][]byte
+		var signatures []string
+		failures := 0
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, body)
+			signatures = append(signatures, r.Header.Get("X-Signature"))
+		}))
+
+		cfg.WebhookURL = server.URL
+		cfg.WebhookSecret = "secret"
+
+		fake := &fakeEC2{}
+		restore := useFakeEC2(fake)
+		data, _ := json.Marshal(testEvent)
+
+		Convey("When an event completes", func() {
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should post the signed result", func() {
+				So(bodies, ShouldHaveLength, 1)
+				So(string(bodies[0]), ShouldContainSubstring, `"status":"deleted"`)
+				So(signatures[0], ShouldEqual, "sha256="+sign("secret", bodies[0]))
+			})
+
+			Convey("It should leave the credentials out", func() {
+				So(string(bodies[0]), ShouldContainSubstring, `"_uuid":"test"`)
+				So(string(bodies[0]), ShouldNotContainSubstring, `"datacenter_secret"`)
+				So(string(bodies[0]), ShouldNotContainSubstring, `"datacenter_token"`)
+			})
+		})
+
+		Convey("When an audited event sent as a request completes", func() {
+			cfg.AuditSubject = "firewall.delete.aws.audit"
+			eventHandler(cfg, &nats.Msg{Data: data, Reply: "test.reply.webhook"})
+
+			Convey("It should only post the result once", func() {
+				So(bodies, ShouldHaveLength, 1)
+				So(string(bodies[0]), ShouldContainSubstring, `"status":"deleted"`)
+			})
+		})
+
+		Convey("When an event fails", func() {
+			fake.deleteErr = os.ErrPermission
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should post the error result", func() {
+				So(bodies, ShouldHaveLength, 1)
+				So(string(bodies[0]), ShouldContainSubstring, `"status":"failed"`)
+			})
+		})
+
+		Convey("When the webhook fails at first", func() {
+			failures = 2
+			eventHandler(cfg, &nats.Msg{Data: data})
+
+			Convey("It should retry until it is delivered", func() {
+				So(bodies, ShouldHaveLength, 1)
+			})
+		})
+
+		Convey("When the webhook doesn't answer", func() {
+			hung := make(chan struct{})
+			slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-hung:
+				case <-r.Context().Done():
+				}
+			}))
+			defer slow.Close()
+			defer close(hung)
+			cfg.WebhookURL = slow.URL
+			cfg.WebhookTimeout = 50 * time.Millisecond
+
+			start := time.Now()
+			err := notifyWebhook(cfg, data)
+
+			Convey("It should give up once the delivery times out", func() {
+				So(err, ShouldNotBeNil)
+				So(time.Since(start), ShouldBeLessThan, time.Second)
+			})
+		})
+
+		Reset(func() {
+			server.Close()
+			newTimer = time.NewTimer
+			restore()
+			log.SetOutput(os.Stdout)
+		})
+	})
+}
@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import "sync"
+
+// events handles delete events on the configured number of workers, nil
+// handles them on the subscription's own goroutine
+var events *workerPool
+
+// workerPool runs events on a fixed number of goroutines. Delivery
+// blocks while every worker is busy, leaving the rest with nats. An
+// extra worker is reserved for high priority events, so they don't wait
+// for the normal events in flight.
+type workerPool struct {
+	queue    chan func()
+	reserved chan func()
+
+	mu   sync.Mutex
+	idle *sync.Cond
+	busy int
+}
+
+// newWorkerPool starts n workers
+func newWorkerPool(n int) *workerPool {
+	if n < 1 {
+		n = 1
+	}
+
+	p := &workerPool{queue: make(chan func()), reserved: make(chan func())}
+	p.idle = sync.NewCond(&p.mu)
+	for i := 0; i < n; i++ {
+		go p.work(p.queue)
+	}
+	go p.work(p.reserved)
+
+	return p
+}
+
+// run hands f to the next free worker, blocking until there is one. High
+// priority events may also take the reserved worker.
+func (p *workerPool) run(priority bool, f func()) {
+	if p == nil {
+		f()
+		return
+	}
+
+	p.mu.Lock()
+	p.busy++
+	p.mu.Unlock()
+
+	if !priority {
+		p.queue <- f
+		return
+	}
+
+	select {
+	case p.queue <- f:
+	case p.reserved <- f:
+	}
+}
+
+func (p *workerPool) work(queue chan func()) {
+	for f := range queue {
+		f()
+
+		p.mu.Lock()
+		p.busy--
+		p.idle.Broadcast()
+		p.mu.Unlock()
+	}
+}
+
+// wait blocks until no more than own events are still running, own
+// being those of the caller
+func (p *workerPool) wait(own int) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	for p.busy > own {
+		p.idle.Wait()
+	}
+	p.mu.Unlock()
+}
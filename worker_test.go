@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReservedWorker(t *testing.T) {
+	Convey("Given every worker busy with a normal event", t, func() {
+		pool := newWorkerPool(1)
+		release := make(chan struct{})
+		pool.run(false, func() { <-release })
+
+		ran := func(priority bool) bool {
+			done := make(chan struct{})
+			go pool.run(priority, func() { close(done) })
+			select {
+			case <-done:
+				return true
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}
+
+		Convey("When a normal event arrives", func() {
+			Convey("It should wait for a free worker", func() {
+				So(ran(false), ShouldBeFalse)
+			})
+		})
+
+		Convey("When a high priority event arrives", func() {
+			Convey("It should run on the reserved worker", func() {
+				So(ran(true), ShouldBeTrue)
+			})
+		})
+
+		Reset(func() {
+			close(release)
+			pool.wait(0)
+		})
+	})
+}
+
+func TestPrioritized(t *testing.T) {
+	Convey("Given raw events", t, func() {
+		Convey("It should only prioritize those asking for high priority", func() {
+			So(prioritized([]byte(`{"priority":"high"}`)), ShouldBeTrue)
+			So(prioritized([]byte(`{"priority":"low"}`)), ShouldBeFalse)
+			So(prioritized([]byte(`{}`)), ShouldBeFalse)
+			So(prioritized([]byte(`not json`)), ShouldBeFalse)
+		})
+	})
+}